@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"github.com/go-ini/ini"
+	"github.com/masif-upgrader/common"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+)
+
+type adminUserContextKey struct{}
+
+// newAdmin creates the HTTPd for operators (as opposed to agents).
+func newAdmin(
+	adminCfg struct{ listen, users string }, tlsCfg struct{ cert, key, ca, crl, ocsp, ocspResponder string },
+) (*http.Server, error) {
+	log.WithFields(log.Fields{"cert": tlsCfg.cert, "key": tlsCfg.key}).Debug("Loading local TLS PKI for admin API")
+
+	cert, errLXKP := tls.LoadX509KeyPair(tlsCfg.cert, tlsCfg.key)
+	if errLXKP != nil {
+		return nil, errLXKP
+	}
+
+	users := map[string][]byte{}
+
+	if adminCfg.users != "" {
+		log.WithFields(log.Fields{"file": adminCfg.users}).Debug("Loading admin API users")
+
+		rawUsers, errLI := ini.Load(adminCfg.users)
+		if errLI != nil {
+			return nil, errLI
+		}
+
+		for _, key := range rawUsers.Section("").Keys() {
+			users[key.Name()] = []byte(key.String())
+		}
+	}
+
+	auth := func(handler http.HandlerFunc) http.Handler {
+		return adminMkAuthMiddleware(users, handler)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(linkPath, linkHandler)
+	mux.HandleFunc("/health", leaderHealth)
+	mux.Handle("/v1/audit", auth(adminV1Audit))
+	mux.Handle("/v1/approvals", auth(adminV1Approvals))
+	mux.Handle("/v1/rejections", auth(adminV1Rejections))
+	mux.Handle("/v1/explain", auth(adminV1Explain))
+	mux.Handle("/v1/simulations", auth(adminV1Simulations))
+	mux.Handle("/v1/pending-tasks", auth(adminV1PendingTasks))
+	mux.Handle("/v1/bulk-approvals", auth(adminV1BulkApprovals))
+	mux.Handle("/v1/jobs", auth(adminV1Jobs))
+	mux.HandleFunc("/", apiDefault)
+
+	return &http.Server{
+		Addr:    adminCfg.listen,
+		Handler: apiMkLoggingMiddleware(mux),
+		TLSConfig: &tls.Config{
+			Certificates:             []tls.Certificate{cert},
+			CipherSuites:             common.ApiTlsCipherSuites,
+			PreferServerCipherSuites: true,
+			MinVersion:               common.ApiTlsMinVersion,
+		},
+	}, nil
+}
+
+// adminMkAuthMiddleware requires HTTP basic auth by one of users (names to bcrypt hashes).
+func adminMkAuthMiddleware(users map[string][]byte, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, hasAuth := r.BasicAuth()
+		if hasAuth {
+			if hash, hasUser := users[user]; hasUser && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil {
+				handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminUserContextKey{}, user)))
+				return
+			}
+
+			log.WithFields(log.Fields{"remote": r.RemoteAddr, "user": user}).Warn("Admin API authentication failed")
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="Masif Upgrader"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+}
+
+// adminActor returns the authenticated operator for the audit trail.
+func adminActor(r *http.Request) string {
+	if user, ok := r.Context().Value(adminUserContextKey{}).(string); ok {
+		return "admin:" + user
+	}
+
+	return ""
+}
+
+func adminRespond(writer http.ResponseWriter, result interface{}) {
+	jsn, errJM := json.Marshal(result)
+	if errJM != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(jsn)
+}
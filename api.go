@@ -3,50 +3,99 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
-	"errors"
+	"encoding/json"
+	"encoding/pem"
 	"github.com/masif-upgrader/common"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
-	"sync"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func newApi(listen string, tlsCfg struct{ cert, key, ca, crl string }) (result *http.Server, err error) {
-	log.WithFields(log.Fields{"cert": tlsCfg.cert, "key": tlsCfg.key}).Debug("Loading local TLS PKI")
+func newApi(
+	listen string, tlsCfg struct{ cert, key, ca, crl, ocsp, ocspResponder string },
+	proxyCfg struct {
+		header  string
+		trusted []*net.IPNet
+	},
+	identities *identityMapper,
+) (result *http.Server, err error) {
+	log.WithFields(log.Fields{"ca": tlsCfg.ca}).Debug("Loading remote TLS PKI")
 
-	cert, errLXKP := tls.LoadX509KeyPair(tlsCfg.cert, tlsCfg.key)
-	if errLXKP != nil {
-		return nil, errLXKP
+	rootCAs, rootCAList, errLC := apiLoadCas(tlsCfg.ca)
+	if errLC != nil {
+		return nil, errLC
 	}
 
-	log.WithFields(log.Fields{"ca": tlsCfg.ca}).Debug("Loading remote TLS PKI")
+	var validators []func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error = nil
 
-	rootCA, errRF := ioutil.ReadFile(tlsCfg.ca)
-	if errRF != nil {
-		return nil, errRF
+	if tlsCfg.crl != "" {
+		crls, errNCS := newCrlStore(tlsCfg.crl, rootCAList)
+		if errNCS != nil {
+			return nil, errNCS
+		}
+
+		go crls.watch()
+
+		validators = append(validators, crls.validator())
 	}
 
-	rootCAs := x509.NewCertPool()
-	rootCAs.AppendCertsFromPEM(rootCA)
+	if tlsCfg.ocsp != "" && tlsCfg.ocsp != "off" {
+		validators = append(validators, newOcspChecker(tlsCfg.ocsp, tlsCfg.ocspResponder).validator())
+	}
 
-	var crlValidator func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error = nil
-	if tlsCfg.crl != "" {
-		crlValidator = apiMkCrlValidator(tlsCfg.crl)
+	var peerValidator func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error = nil
+	if len(validators) > 0 {
+		peerValidator = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, validator := range validators {
+				if errVal := validator(rawCerts, verifiedChains); errVal != nil {
+					return errVal
+				}
+			}
+
+			return nil
+		}
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/v1/pending-tasks", apiV1PendingTasks)
+	mux.HandleFunc("/v2/pending-tasks", apiV2PendingTasks)
 	mux.HandleFunc("/", apiDefault)
 
+	if proxyCfg.header != "" {
+		proxy := &proxyVerifier{
+			header:    proxyCfg.header,
+			trusted:   proxyCfg.trusted,
+			unix:      strings.HasPrefix(listen, "unix:"),
+			roots:     rootCAs,
+			validator: peerValidator,
+		}
+
+		return &http.Server{
+			Addr:    listen,
+			Handler: proxy.middleware(identities.middleware(apiMkLoggingMiddleware(mux))),
+		}, nil
+	}
+
+	log.WithFields(log.Fields{"cert": tlsCfg.cert, "key": tlsCfg.key}).Debug("Loading local TLS PKI")
+
+	cert, errLXKP := tls.LoadX509KeyPair(tlsCfg.cert, tlsCfg.key)
+	if errLXKP != nil {
+		return nil, errLXKP
+	}
+
 	return &http.Server{
 		Addr:    listen,
-		Handler: apiMkLoggingMiddleware(mux),
+		Handler: identities.middleware(apiMkLoggingMiddleware(mux)),
 		TLSConfig: &tls.Config{
 			Certificates:             []tls.Certificate{cert},
-			VerifyPeerCertificate:    crlValidator,
+			VerifyPeerCertificate:    peerValidator,
 			ClientAuth:               tls.RequireAndVerifyClientCert,
 			ClientCAs:                rootCAs,
 			CipherSuites:             common.ApiTlsCipherSuites,
@@ -56,13 +105,63 @@ func newApi(listen string, tlsCfg struct{ cert, key, ca, crl string }) (result *
 	}, nil
 }
 
+// apiServe serves httpd via TLS or - behind a reverse proxy - via plain HTTP on TCP or a Unix socket.
+func apiServe(httpd *http.Server) error {
+	if httpd.TLSConfig != nil {
+		return httpd.ListenAndServeTLS("", "")
+	}
+
+	if socket := strings.TrimPrefix(httpd.Addr, "unix:"); socket != httpd.Addr {
+		if errRm := os.Remove(socket); errRm != nil && !os.IsNotExist(errRm) {
+			return errRm
+		}
+
+		listener, errLs := net.Listen("unix", socket)
+		if errLs != nil {
+			return errLs
+		}
+
+		return httpd.Serve(listener)
+	}
+
+	return httpd.ListenAndServe()
+}
+
+func apiLoadCas(path string) (pool *x509.CertPool, certs []*x509.Certificate, err error) {
+	rootCA, errRF := ioutil.ReadFile(path)
+	if errRF != nil {
+		return nil, nil, errRF
+	}
+
+	pool = x509.NewCertPool()
+	pool.AppendCertsFromPEM(rootCA)
+
+	for rest := rootCA; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+
+		if block.Type == "CERTIFICATE" {
+			cert, errPC := x509.ParseCertificate(block.Bytes)
+			if errPC != nil {
+				return nil, nil, errPC
+			}
+
+			certs = append(certs, cert)
+		}
+	}
+
+	return
+}
+
 func apiMkLoggingMiddleware(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.WithFields(log.Fields{
 			"remote":   r.RemoteAddr,
-			"cn":       r.TLS.VerifiedChains[0][0].Subject.CommonName,
+			"agent":    identityAgent(r),
 			"method":   r.Method,
-			"url":      common.LazyLogString{r.URL.String},
+			"url":      common.LazyLogString{Generator: r.URL.String},
 			"protocol": r.Proto,
 			"length":   r.ContentLength,
 		}).Info("Handling request")
@@ -71,111 +170,143 @@ func apiMkLoggingMiddleware(handler http.Handler) http.Handler {
 	})
 }
 
-var apiRevoked = errors.New("all valid certificates directly below root have been revoked")
-
-func apiMkCrlValidator(crlPath string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-	mutex := sync.RWMutex{}
-	var timesUpdated uint64 = 0
-	var crl *pkix.CertificateList = nil
-	lastUpdate := time.Now()
-	var revokedCerts map[string]struct{} = nil
-
-	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-		log.Debug("Checking the remote's TLS certificate chain for at least one non-revoked path")
-
-		mutex.RLock()
-
-		update := false
-
-		if crl == nil {
-			log.Info("Initially loading CRL")
-
-			update = true
-		} else {
-			if crl.HasExpired(time.Now()) {
-				stats, errStat := os.Stat(crlPath)
-				if errStat != nil {
-					mutex.RUnlock()
-					return errStat
-				}
+func apiV1PendingTasks(writer http.ResponseWriter, request *http.Request) {
+	statuses, _, ok := apiUpdatePendingTasks(writer, request)
+	if !ok {
+		return
+	}
 
-				update = stats.ModTime().After(lastUpdate)
+	approvedTasks := map[common.PkgMgrTask]struct{}{}
 
-				if update {
-					log.Info("CRL has expired, re-loading")
-				} else {
-					log.Warn("CRL has expired, but isn't likely to have been updated, not re-loading")
-				}
-			}
+	for task, status := range statuses {
+		if status.Status == taskApproved {
+			approvedTasks[task] = struct{}{}
 		}
+	}
 
-		if update {
-			timesUpdatedLastSeen := timesUpdated
-
-			mutex.RUnlock()
-			mutex.Lock()
+	jsn, errPMT2A := common.PkgMgrTasks2Api(approvedTasks)
+	if errPMT2A != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-			if timesUpdated == timesUpdatedLastSeen {
-				timesUpdated++
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(jsn)
+}
 
-				now := time.Now()
+const (
+	taskApproved = "approved"
+	taskPending  = "pending"
+	taskHeld     = "held"
+)
 
-				rawCRL, errRF := ioutil.ReadFile(crlPath)
-				if errRF != nil {
-					mutex.Unlock()
-					return errRF
-				}
+// taskStatus tells an agent whether it may run a task and why (not).
+type taskStatus struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
 
-				freshCRL, errPCRL := x509.ParseCRL(rawCRL)
-				if errPCRL != nil {
-					mutex.Unlock()
-					return errPCRL
-				}
+// apiV2PendingTasks is like apiV1PendingTasks, but returns all tasks with their status.
+func apiV2PendingTasks(writer http.ResponseWriter, request *http.Request) {
+	statuses, nextPoll, ok := apiUpdatePendingTasks(writer, request)
+	if !ok {
+		return
+	}
 
-				crl = freshCRL
-				lastUpdate = now
+	type apiTask struct {
+		Package     string  `json:"package"`
+		FromVersion *string `json:"from_version,omitempty"`
+		ToVersion   *string `json:"to_version,omitempty"`
+		Action      string  `json:"action"`
+		*taskStatus
+	}
 
-				revokedCerts = map[string]struct{}{}
-				for _, revokedCert := range crl.TBSCertList.RevokedCertificates {
-					revokedCerts[revokedCert.SerialNumber.Text(16)] = struct{}{}
-				}
-			}
+	response := struct {
+		Tasks    []apiTask `json:"tasks"`
+		NextPoll int64     `json:"next_poll"`
+	}{make([]apiTask, 0, len(statuses)), nextPoll.Unix()}
+
+	for task, status := range statuses {
+		response.Tasks = append(response.Tasks, apiTask{
+			Package:     task.PackageName,
+			FromVersion: apiOptional(task.FromVersion),
+			ToVersion:   apiOptional(task.ToVersion),
+			Action:      pkgMgrAction2db[task.Action],
+			taskStatus:  status,
+		})
+	}
 
-			mutex.Unlock()
-			mutex.RLock()
+	sort.Slice(response.Tasks, func(i, j int) bool {
+		a, b := &response.Tasks[i], &response.Tasks[j]
+
+		switch {
+		case a.Package != b.Package:
+			return a.Package < b.Package
+		case a.Action != b.Action:
+			return a.Action < b.Action
+		case !apiOptionalEqual(a.FromVersion, b.FromVersion):
+			return apiOptionalLess(a.FromVersion, b.FromVersion)
+		default:
+			return apiOptionalLess(a.ToVersion, b.ToVersion)
 		}
+	})
 
-		defer mutex.RUnlock()
+	jsn, errJM := json.Marshal(&response)
+	if errJM != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-		for _, chains := range verifiedChains {
-			if chains[len(chains)-1].CheckCRLSignature(crl) == nil {
-				if _, isRevoked := revokedCerts[chains[len(chains)-2].SerialNumber.Text(16)]; !isRevoked {
-					log.Debug("Found non-revoked path in the remote's TLS certificate chain")
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(jsn)
+}
 
-					return nil
-				}
-			}
-		}
+func apiOptional(s string) *string {
+	if s == "" {
+		return nil
+	}
 
-		log.Warn("Didn't find any non-revoked path in the remote's TLS certificate chain")
+	return &s
+}
 
-		return apiRevoked
-	}
+func apiOptionalEqual(a, b *string) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
 }
 
-func apiV1PendingTasks(writer http.ResponseWriter, request *http.Request) {
-	cn := request.TLS.VerifiedChains[0][0].Subject.CommonName
-	if cn == "" {
-		writer.WriteHeader(http.StatusBadRequest)
-		writer.Write([]byte("empty TLS cert CN"))
-		return
-	}
+// apiOptionalLess orders missing values first.
+func apiOptionalLess(a, b *string) bool {
+	return a == nil && b != nil || a != nil && b != nil && *a < *b
+}
 
+// apiUpdatePendingTasks handles the agent's POSTed tasks, tells it when to poll again
+// and tells whether it didn't already respond.
+// If the agent asks to wait up to N seconds (?wait=N) and nothing is approved yet,
+// it does so until something is.
+func apiUpdatePendingTasks(
+	writer http.ResponseWriter, request *http.Request,
+) (statuses map[common.PkgMgrTask]*taskStatus, nextPoll time.Time, ok bool) {
 	if request.Method != "POST" {
 		writer.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
+	var wait time.Duration
+
+	if rawWait := request.URL.Query().Get("wait"); rawWait != "" {
+		seconds, errPI := strconv.ParseUint(rawWait, 10, 32)
+		if errPI != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write([]byte("bad wait"))
+			return
+		}
+
+		if wait = time.Duration(seconds) * time.Second; wait > polling.maxWait {
+			wait = polling.maxWait
+		}
+	}
+
 	body, errRA := ioutil.ReadAll(request.Body)
 	if errRA != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
@@ -189,21 +320,69 @@ func apiV1PendingTasks(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	approvedTasks, errAUPT := dbUpdatePendingTasks(cn, tasks)
-	if errAUPT != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		return
+	agent := identityAgent(request)
+	var notifications chan struct{}
+	var deadline <-chan time.Time
+
+	if wait > 0 && len(tasks) > 0 {
+		// Subscribe before looking for approvals not to miss any in between.
+		notifications = approvalHub.subscribe(agent)
+		defer approvalHub.unsubscribe(agent, notifications)
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		deadline = timer.C
 	}
 
-	jsn, errPMT2A := common.PkgMgrTasks2Api(approvedTasks)
-	if errPMT2A != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		return
+	for {
+		if !pollAcquire() {
+			pollOverload(writer)
+			return
+		}
+
+		var errAUPT error
+		statuses, errAUPT = dbUpdatePendingTasks(request.Context(), agent, tasks)
+		pollRelease()
+
+		if errAUPT != nil {
+			if isOverloadDbError(errAUPT) {
+				pollOverload(writer)
+			} else {
+				writer.WriteHeader(http.StatusInternalServerError)
+			}
+
+			return
+		}
+
+		if notifications == nil || apiAnyApproved(statuses) {
+			break
+		}
+
+		select {
+		case <-notifications:
+			// Don't let all waiting agents hit the database at once.
+			time.Sleep(time.Duration(rand.Int63n(int64(time.Second))))
+			continue
+		case <-deadline:
+		case <-request.Context().Done():
+			return
+		}
+
+		break
 	}
 
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(http.StatusOK)
-	writer.Write(jsn)
+	return statuses, pollSetRetryAfter(writer, pollNext()), true
+}
+
+func apiAnyApproved(statuses map[common.PkgMgrTask]*taskStatus) bool {
+	for _, status := range statuses {
+		if status.Status == taskApproved {
+			return true
+		}
+	}
+
+	return false
 }
 
 func apiDefault(writer http.ResponseWriter, request *http.Request) {
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/masif-upgrader/common"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+)
+
+var approvalNoSuchAgent = errors.New("no such agent")
+
+// approvalRules map approved tasks (with wildcards) to the distinct operators who have approved them.
+// nil instead of the operators means approved regardless of any quorum, e.g. during a simulation.
+type approvalRules map[common.PkgMgrTask]map[string]struct{}
+
+type quorumRule struct {
+	pattern string
+	n       int
+}
+
+// quorums require multiple distinct approvers for packages matching their patterns.
+var quorums []quorumRule = nil
+
+// quorumFor returns how many distinct approvers a task of the package needs.
+func quorumFor(packageName string) int {
+	n := 1
+
+	for _, rule := range quorums {
+		if matches, _ := path.Match(rule.pattern, packageName); matches && rule.n > n {
+			n = rule.n
+		}
+	}
+
+	return n
+}
+
+// approvalPseudoTasks returns all rules which would match task, the most specific one first.
+func approvalPseudoTasks(task common.PkgMgrTask) []common.PkgMgrTask {
+	pseudoTasks := []common.PkgMgrTask{}
+
+	for _, packageName := range approvalWithWildcard(task.PackageName) {
+		for _, fromVersion := range approvalWithWildcard(task.FromVersion) {
+			for _, toVersion := range approvalWithWildcard(task.ToVersion) {
+				actions := []common.PkgMgrAction{task.Action}
+				if task.Action != 255 {
+					actions = append(actions, 255)
+				}
+
+				for _, action := range actions {
+					pseudoTasks = append(pseudoTasks, common.PkgMgrTask{
+						PackageName: packageName,
+						FromVersion: fromVersion,
+						ToVersion:   toVersion,
+						Action:      action,
+					})
+				}
+			}
+		}
+	}
+
+	return pseudoTasks
+}
+
+func approvalWithWildcard(value string) []string {
+	if value == "" {
+		return []string{""}
+	}
+
+	return []string{value, ""}
+}
+
+// approvalMatch is a rule matching a particular task.
+type approvalMatch struct {
+	rule      common.PkgMgrTask
+	global    bool
+	approvers int
+	quorum    int
+}
+
+func (m *approvalMatch) effective() bool {
+	return m.quorum <= 1 || m.approvers >= m.quorum
+}
+
+func (m *approvalMatch) reason() string {
+	scope := "agent-specific"
+	if m.global {
+		scope = "global"
+	}
+
+	if m.effective() {
+		return "approved by " + scope + " rule " + fmtTask(m.rule)
+	}
+
+	return fmt.Sprintf(
+		"%s rule %s is waiting for quorum: %d of %d approvers", scope, fmtTask(m.rule), m.approvers, m.quorum,
+	)
+}
+
+// approvalMatches returns all rules matching task, agent-specific and most specific ones first.
+func approvalMatches(task common.PkgMgrTask, global, forAgent approvalRules) []approvalMatch {
+	matches := []approvalMatch{}
+	quorum := quorumFor(task.PackageName)
+
+	for i, rules := range []approvalRules{forAgent, global} {
+		for _, pseudoTask := range approvalPseudoTasks(task) {
+			if approvers, isApproved := rules[pseudoTask]; isApproved {
+				match := approvalMatch{rule: pseudoTask, global: i > 0, approvers: len(approvers), quorum: quorum}
+				if approvers == nil {
+					match.approvers = quorum
+				}
+
+				matches = append(matches, match)
+			}
+		}
+	}
+
+	return matches
+}
+
+// approvalCheck tells whether task is approved by any rule.
+func approvalCheck(task common.PkgMgrTask, global, forAgent approvalRules) bool {
+	for _, match := range approvalMatches(task, global, forAgent) {
+		if match.effective() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dbGetApprovals returns the approval rules for agent (nil for global ones).
+func dbGetApprovals(tx *sql.Tx, agent interface{}) (approvalRules, error) {
+	tasks, errDGT := dbGetTasks(tx, agent, 1)
+	if errDGT != nil {
+		return nil, errDGT
+	}
+
+	rules := make(approvalRules, len(tasks))
+
+	for task := range tasks {
+		rules[task] = map[string]struct{}{}
+	}
+
+	if len(quorums) > 0 && len(tasks) > 0 {
+		query := `
+SELECT p.name, v.from_version, v.to_version, v.action, v.approver
+FROM approval_vote v
+LEFT JOIN package p ON p.id=v.package
+WHERE v.agent<=>?`
+
+		rows, errQuery := dbQuery(tx, query, agent)
+		if errQuery != nil {
+			return nil, errQuery
+		}
+
+		for _, row := range rows {
+			if approvers, isApproved := rules[dbRow2Task(row)]; isApproved {
+				approvers[string(row[4].([]byte))] = struct{}{}
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// dbGetAgentId returns the ID of the agent named agent or nil if it's empty.
+func dbGetAgentId(tx *sql.Tx, agent string) (interface{}, error) {
+	if agent == "" {
+		return nil, nil
+	}
+
+	rows, errQuery := dbQuery(tx, `SELECT id FROM agent WHERE name=?`, agent)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+
+	if len(rows) < 1 {
+		return nil, approvalNoSuchAgent
+	}
+
+	return rows[0][0].(int64), nil
+}
+
+// dbGetPackageId returns the ID of the package named packageName (creating it if necessary) or nil if it's empty.
+func dbGetPackageId(tx *sql.Tx, packageName string) (interface{}, error) {
+	if packageName == "" {
+		return nil, nil
+	}
+
+	rows, errQuery := dbQuery(tx, `SELECT id FROM package WHERE name=?`, packageName)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+
+	if len(rows) > 0 {
+		return rows[0][0].(int64), nil
+	}
+
+	result, errExec := dbExec(tx, `INSERT INTO package(name) VALUES (?)`, packageName)
+	if errExec != nil {
+		return nil, errExec
+	}
+
+	return result.LastInsertId()
+}
+
+const approvalRuleFilter = `agent<=>? AND package<=>? AND from_version<=>? AND to_version<=>? AND action<=>?`
+
+func approvalRuleValues(agentId, packageId interface{}, task common.PkgMgrTask) []interface{} {
+	var action interface{} = nil
+	if task.Action != 255 {
+		action = pkgMgrAction2db[task.Action]
+	}
+
+	return []interface{}{agentId, packageId, dbNullString(task.FromVersion), dbNullString(task.ToVersion), action}
+}
+
+// dbAudit records an event not covered by the audit triggers.
+func dbAudit(tx *sql.Tx, event, agent string, task common.PkgMgrTask) error {
+	var action interface{} = nil
+	if task.Action != 255 {
+		action = pkgMgrAction2db[task.Action]
+	}
+
+	_, errExec := dbExec(
+		tx,
+		`
+INSERT INTO audit(time, actor, event, agent, package, from_version, to_version, action)
+VALUES (?, @masif_actor, ?, ?, ?, ?, ?, ?)
+`,
+		time.Now().Unix(),
+		event,
+		dbNullString(agent),
+		dbNullString(task.PackageName),
+		dbNullString(task.FromVersion),
+		dbNullString(task.ToVersion),
+		action,
+	)
+	return errExec
+}
+
+type approvalState struct {
+	Approvers int  `json:"approvers"`
+	Quorum    int  `json:"quorum"`
+	Approved  bool `json:"approved"`
+}
+
+// dbApprove records approver's approval of task for agent (empty for all agents)
+// and approves the task once enough distinct operators have done so.
+func dbApprove(tx *sql.Tx, approver, agent string, task common.PkgMgrTask) (state approvalState, err error) {
+	agentId, errGAI := dbGetAgentId(tx, agent)
+	if errGAI != nil {
+		return state, errGAI
+	}
+
+	packageId, errGPI := dbGetPackageId(tx, task.PackageName)
+	if errGPI != nil {
+		return state, errGPI
+	}
+
+	values := approvalRuleValues(agentId, packageId, task)
+
+	rows, errQuery := dbQuery(
+		tx, `SELECT 1 FROM approval_vote WHERE `+approvalRuleFilter+` AND approver=?`, append(values, approver)...,
+	)
+	if errQuery != nil {
+		return state, errQuery
+	}
+
+	if len(rows) < 1 {
+		_, errExec := dbExec(
+			tx,
+			`
+INSERT INTO approval_vote(agent, package, from_version, to_version, action, approver, ctime)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+`,
+			append(values, approver, time.Now().Unix())...,
+		)
+		if errExec != nil {
+			return state, errExec
+		}
+
+		if errAu := dbAudit(tx, "task_vote", agent, task); errAu != nil {
+			return state, errAu
+		}
+	}
+
+	rows, errQuery = dbQuery(
+		tx, `SELECT COUNT(DISTINCT approver) FROM approval_vote WHERE `+approvalRuleFilter, values...,
+	)
+	if errQuery != nil {
+		return state, errQuery
+	}
+
+	state.Approvers = int(dbInt(rows[0][0]))
+	state.Quorum = quorumFor(task.PackageName)
+
+	if state.Approvers < state.Quorum {
+		return state, nil
+	}
+
+	state.Approved = true
+
+	rows, errQuery = dbQuery(tx, `SELECT MAX(approved) FROM task WHERE `+approvalRuleFilter, values...)
+	if errQuery != nil {
+		return state, errQuery
+	}
+
+	switch {
+	case rows[0][0] == nil:
+		_, errExec := dbExec(
+			tx,
+			`
+INSERT INTO task(agent, package, from_version, to_version, action, approved, ctime)
+VALUES (?, ?, ?, ?, ?, 1, ?)
+`,
+			append(values, time.Now().Unix())...,
+		)
+		return state, errExec
+	case dbInt(rows[0][0]) == 0:
+		_, errExec := dbExec(tx, `UPDATE task SET approved=1 WHERE approved=0 AND `+approvalRuleFilter, values...)
+		return state, errExec
+	}
+
+	return state, nil
+}
+
+// dbReject clears all approvals of task for agent (empty for all agents).
+func dbReject(tx *sql.Tx, agent string, task common.PkgMgrTask) error {
+	agentId, errGAI := dbGetAgentId(tx, agent)
+	if errGAI != nil {
+		return errGAI
+	}
+
+	packageId, errGPI := dbGetPackageId(tx, task.PackageName)
+	if errGPI != nil {
+		return errGPI
+	}
+
+	values := approvalRuleValues(agentId, packageId, task)
+
+	if _, errExec := dbExec(tx, `DELETE FROM approval_vote WHERE `+approvalRuleFilter, values...); errExec != nil {
+		return errExec
+	}
+
+	if _, errExec := dbExec(tx, `DELETE FROM task WHERE approved=1 AND `+approvalRuleFilter, values...); errExec != nil {
+		return errExec
+	}
+
+	return dbAudit(tx, "task_deny", agent, task)
+}
+
+// dbApprovePendingTasks approves task for agent or - if empty - all agents currently requesting it.
+// It returns how many of them are approved now.
+func dbApprovePendingTasks(tx *sql.Tx, approver, agent string, task common.PkgMgrTask) (approved int64, err error) {
+	query := `
+SELECT DISTINCT a.name
+FROM task t
+INNER JOIN agent a ON a.id=t.agent
+INNER JOIN package p ON p.id=t.package
+WHERE t.approved=0 AND p.name=? AND t.from_version<=>? AND t.to_version<=>? AND t.action=?`
+
+	values := []interface{}{
+		task.PackageName, dbNullString(task.FromVersion), dbNullString(task.ToVersion), pkgMgrAction2db[task.Action],
+	}
+
+	if agent != "" {
+		query += " AND a.name=?"
+		values = append(values, agent)
+	}
+
+	rows, errQuery := dbQuery(tx, query, values...)
+	if errQuery != nil {
+		return 0, errQuery
+	}
+
+	for _, row := range rows {
+		state, errAp := dbApprove(tx, approver, string(row[0].([]byte)), task)
+		if errAp != nil {
+			return 0, errAp
+		}
+
+		if state.Approved {
+			approved++
+		}
+	}
+
+	return
+}
+
+// approvalRule is the API representation of a (partially) approved task.
+type approvalRule struct {
+	Agent       *string  `json:"agent"`
+	Package     *string  `json:"package"`
+	FromVersion *string  `json:"from_version"`
+	ToVersion   *string  `json:"to_version"`
+	Action      *string  `json:"action"`
+	Approved    bool     `json:"approved"`
+	Approvers   []string `json:"approvers"`
+	Quorum      int      `json:"quorum"`
+}
+
+// approvalParseRule parses an API request body like {"agent": "web01", "package": "nginx"}.
+// Missing fields are wildcards, a missing agent means all agents.
+func approvalParseRule(body []byte) (agent string, task common.PkgMgrTask, err error) {
+	var rule struct {
+		Agent       string `json:"agent"`
+		Package     string `json:"package"`
+		FromVersion string `json:"from_version"`
+		ToVersion   string `json:"to_version"`
+		Action      string `json:"action"`
+	}
+
+	if errJU := json.Unmarshal(body, &rule); errJU != nil {
+		return "", task, errJU
+	}
+
+	task, err = approvalRuleTask(rule.Package, rule.FromVersion, rule.ToVersion, rule.Action)
+	return rule.Agent, task, err
+}
+
+// approvalRuleTask builds a rule's task from its fields, empty ones being wildcards.
+func approvalRuleTask(packageName, fromVersion, toVersion, action string) (common.PkgMgrTask, error) {
+	task := common.PkgMgrTask{
+		PackageName: packageName,
+		FromVersion: fromVersion,
+		ToVersion:   toVersion,
+		Action:      255,
+	}
+
+	if action != "" {
+		pkgMgrAction, actionValid := db2pkgMgrAction[action]
+		if !actionValid {
+			return task, errors.New("bad action")
+		}
+
+		task.Action = pkgMgrAction
+	}
+
+	return task, nil
+}
+
+// adminV1Approvals lists approval rules incl. partial ones on GET and approves on POST.
+func adminV1Approvals(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "GET":
+		var rules []approvalRule
+
+		if errTx := dbReadTx(request.Context(), adminActor(request), func(tx *sql.Tx) (err error) {
+			rules, err = dbListApprovals(tx)
+			return
+		}); errTx != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		adminRespond(writer, rules)
+	case "POST":
+		agent, task, errPR := adminReadRule(writer, request)
+		if errPR != nil {
+			return
+		}
+
+		var state approvalState
+
+		errTx := dbTx(request.Context(), adminActor(request), func(tx *sql.Tx) (err error) {
+			state, err = dbApprove(tx, adminActor(request), agent, task)
+			return
+		})
+
+		if adminRespondError(writer, errTx) {
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"actor": adminActor(request), "agent": agent, "task": fmtTask(task),
+			"approvers": state.Approvers, "quorum": state.Quorum,
+		}).Info("Approved task")
+
+		if state.Approved {
+			approvalHub.publish(agent)
+		}
+
+		adminRespond(writer, state)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// adminV1Rejections clears all (partial) approvals of a task.
+func adminV1Rejections(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	agent, task, errPR := adminReadRule(writer, request)
+	if errPR != nil {
+		return
+	}
+
+	errTx := dbTx(request.Context(), adminActor(request), func(tx *sql.Tx) error {
+		return dbReject(tx, agent, task)
+	})
+
+	if adminRespondError(writer, errTx) {
+		return
+	}
+
+	log.WithFields(log.Fields{"actor": adminActor(request), "agent": agent, "task": fmtTask(task)}).Info("Rejected task")
+
+	adminRespond(writer, struct{}{})
+}
+
+func adminReadRule(writer http.ResponseWriter, request *http.Request) (agent string, task common.PkgMgrTask, err error) {
+	body, errRA := ioutil.ReadAll(request.Body)
+	if errRA != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return "", task, errRA
+	}
+
+	agent, task, err = approvalParseRule(body)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte(err.Error()))
+	}
+
+	return
+}
+
+// adminRespondError responds with an error if err isn't nil and tells whether it did so.
+func adminRespondError(writer http.ResponseWriter, err error) bool {
+	switch err {
+	case nil:
+		return false
+	case approvalNoSuchAgent:
+		writer.WriteHeader(http.StatusNotFound)
+		writer.Write([]byte(err.Error()))
+	default:
+		writer.WriteHeader(http.StatusInternalServerError)
+	}
+
+	return true
+}
+
+func dbListApprovals(tx *sql.Tx) ([]approvalRule, error) {
+	type ruleKey struct {
+		agent string
+		task  common.PkgMgrTask
+	}
+
+	rules := map[ruleKey]*approvalRule{}
+
+	for _, query := range []string{
+		`
+SELECT a.name, p.name, t.from_version, t.to_version, t.action, NULL
+FROM task t
+LEFT JOIN agent a ON a.id=t.agent
+LEFT JOIN package p ON p.id=t.package
+WHERE t.approved=?`,
+		`
+SELECT a.name, p.name, v.from_version, v.to_version, v.action, v.approver
+FROM approval_vote v
+LEFT JOIN agent a ON a.id=v.agent
+LEFT JOIN package p ON p.id=v.package
+WHERE 1=?`,
+	} {
+		rows, errQuery := dbQuery(tx, query, 1)
+		if errQuery != nil {
+			return nil, errQuery
+		}
+
+		for _, row := range rows {
+			key := ruleKey{task: dbRow2Task(row[1:5])}
+			if row[0] != nil {
+				key.agent = string(row[0].([]byte))
+			}
+
+			rule, hasRule := rules[key]
+			if !hasRule {
+				rule = &approvalRule{
+					Agent:       dbNullableString(row[0]),
+					Package:     dbNullableString(row[1]),
+					FromVersion: dbNullableString(row[2]),
+					ToVersion:   dbNullableString(row[3]),
+					Action:      dbNullableString(row[4]),
+					Approvers:   []string{},
+					Quorum:      quorumFor(key.task.PackageName),
+				}
+
+				rules[key] = rule
+			}
+
+			if row[5] == nil {
+				rule.Approved = true
+			} else {
+				rule.Approvers = append(rule.Approvers, string(row[5].([]byte)))
+			}
+		}
+	}
+
+	list := make([]approvalRule, 0, len(rules))
+	for _, rule := range rules {
+		sort.Strings(rule.Approvers)
+		list = append(list, *rule)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return approvalRuleSortKey(&list[i]) < approvalRuleSortKey(&list[j])
+	})
+
+	return list, nil
+}
+
+func approvalRuleSortKey(rule *approvalRule) string {
+	var key string
+
+	for _, value := range []*string{rule.Agent, rule.Package, rule.Action, rule.FromVersion, rule.ToVersion} {
+		if value == nil {
+			key += "\x00"
+		} else {
+			key += *value + "\x00"
+		}
+	}
+
+	return key
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/masif-upgrader/common"
+	"testing"
+	"time"
+)
+
+// testQuorums sets quorums until the returned function is called.
+func testQuorums(rules ...quorumRule) func() {
+	quorums = rules
+
+	return func() {
+		quorums = nil
+	}
+}
+
+func testApprovers(names ...string) map[string]struct{} {
+	approvers := map[string]struct{}{}
+	for _, name := range names {
+		approvers[name] = struct{}{}
+	}
+
+	return approvers
+}
+
+func TestQuorumFor(t *testing.T) {
+	defer testQuorums(quorumRule{"openssl*", 2}, quorumRule{"*ssl*", 3}, quorumRule{"linux-*", 2})()
+
+	for packageName, want := range map[string]int{
+		"openssl":       3,
+		"libssl1.1":     3,
+		"linux-image":   2,
+		"nginx":         1,
+		"xlinux-images": 1,
+	} {
+		if got := quorumFor(packageName); got != want {
+			t.Errorf("%s: got %d, want %d", packageName, got, want)
+		}
+	}
+}
+
+func TestApprovalCheck(t *testing.T) {
+	nginx := common.PkgMgrTask{PackageName: "nginx", FromVersion: "1", ToVersion: "2", Action: common.PkgMgrUpdate}
+	openssl := common.PkgMgrTask{PackageName: "openssl", FromVersion: "1", ToVersion: "2", Action: common.PkgMgrUpdate}
+	anyTask := common.PkgMgrTask{Action: 255}
+	anyNginx := common.PkgMgrTask{PackageName: "nginx", Action: 255}
+	anyOpenssl := common.PkgMgrTask{PackageName: "openssl", Action: 255}
+	nginxTo2 := common.PkgMgrTask{PackageName: "nginx", ToVersion: "2", Action: common.PkgMgrUpdate}
+	nginxTo3 := common.PkgMgrTask{PackageName: "nginx", ToVersion: "3", Action: common.PkgMgrUpdate}
+	nginxInstall := common.PkgMgrTask{PackageName: "nginx", Action: common.PkgMgrInstall}
+
+	defer testQuorums(quorumRule{"openssl", 2})()
+
+	cases := []struct {
+		name             string
+		task             common.PkgMgrTask
+		global, forAgent approvalRules
+		want             bool
+		reason           string
+	}{
+		{
+			name: "no rules", task: nginx, want: false,
+		},
+		{
+			name: "exact rule", task: nginx, global: approvalRules{nginx: testApprovers("alice")}, want: true,
+			reason: "approved by global rule nginx: update 1 -> 2",
+		},
+		{
+			name: "any package", task: nginx, global: approvalRules{anyTask: testApprovers("alice")}, want: true,
+			reason: "approved by global rule *: *",
+		},
+		{
+			name: "any version and action", task: nginx, forAgent: approvalRules{anyNginx: testApprovers("alice")},
+			want: true, reason: "approved by agent-specific rule nginx: *",
+		},
+		{
+			name: "any from version", task: nginx, global: approvalRules{nginxTo2: testApprovers("alice")}, want: true,
+		},
+		{
+			name: "other to version", task: nginx, global: approvalRules{nginxTo3: testApprovers("alice")}, want: false,
+		},
+		{
+			name: "other action", task: nginx, global: approvalRules{nginxInstall: testApprovers("alice")}, want: false,
+		},
+		{
+			name: "other package", task: openssl, global: approvalRules{nginx: testApprovers("alice")}, want: false,
+		},
+		{
+			name: "most specific first", task: nginx,
+			global: approvalRules{anyTask: testApprovers("alice"), nginx: testApprovers("bob")}, want: true,
+			reason: "approved by global rule nginx: update 1 -> 2",
+		},
+		{
+			name: "below quorum", task: openssl, global: approvalRules{openssl: testApprovers("alice")}, want: false,
+			reason: "global rule openssl: update 1 -> 2 is waiting for quorum: 1 of 2 approvers",
+		},
+		{
+			name: "at quorum", task: openssl, global: approvalRules{openssl: testApprovers("alice", "bob")}, want: true,
+		},
+		{
+			name: "above quorum", task: openssl, global: approvalRules{openssl: testApprovers("alice", "bob", "carol")},
+			want: true,
+		},
+		{
+			name: "no approvers at all", task: openssl, global: approvalRules{openssl: testApprovers()}, want: false,
+		},
+		{
+			name: "quorum by wildcard rule", task: openssl, global: approvalRules{anyOpenssl: testApprovers("alice", "bob")},
+			want: true,
+		},
+		{
+			name: "quorum not summed up across rules", task: openssl,
+			global:   approvalRules{openssl: testApprovers("alice")},
+			forAgent: approvalRules{anyOpenssl: testApprovers("bob")},
+			want:     false,
+			reason:   "agent-specific rule openssl: * is waiting for quorum: 1 of 2 approvers",
+		},
+		{
+			name: "one of multiple rules effective", task: openssl,
+			global:   approvalRules{openssl: testApprovers("alice", "bob")},
+			forAgent: approvalRules{anyOpenssl: testApprovers("bob")},
+			want:     true,
+		},
+		{
+			name: "simulation regardless of quorum", task: openssl, global: approvalRules{openssl: nil}, want: true,
+		},
+	}
+
+	for _, c := range cases {
+		if got := approvalCheck(c.task, c.global, c.forAgent); got != c.want {
+			t.Errorf("%s: got %t, want %t", c.name, got, c.want)
+		}
+
+		if c.reason != "" {
+			if matches := approvalMatches(c.task, c.global, c.forAgent); len(matches) < 1 {
+				t.Errorf("%s: no matches", c.name)
+			} else if got := matches[0].reason(); got != c.reason {
+				t.Errorf("%s: got reason %q, want %q", c.name, got, c.reason)
+			}
+		}
+	}
+}
+
+func TestDbApproveQuorum(t *testing.T) {
+	testDb(t)
+	defer testQuorums(quorumRule{"openssl", 2})()
+
+	openssl := common.PkgMgrTask{PackageName: "openssl", FromVersion: "1", ToVersion: "2", Action: common.PkgMgrUpdate}
+
+	approve := func(approver string) (state approvalState) {
+		errTx := dbTx(context.Background(), approver, func(tx *sql.Tx) (err error) {
+			state, err = dbApprove(tx, approver, "", openssl)
+			return
+		})
+		if errTx != nil {
+			t.Fatal(errTx)
+		}
+
+		return
+	}
+
+	check := func() (approved bool) {
+		errTx := dbTx(context.Background(), "", func(tx *sql.Tx) error {
+			global, errGA := dbGetApprovals(tx, nil)
+			approved = approvalCheck(openssl, global, nil)
+			return errGA
+		})
+		if errTx != nil {
+			t.Fatal(errTx)
+		}
+
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		if state := approve("alice"); state != (approvalState{Approvers: 1, Quorum: 2, Approved: false}) {
+			t.Errorf("alice's vote #%d: got %#v", i+1, state)
+		}
+	}
+
+	if check() {
+		t.Error("approved by one approver voting twice")
+	}
+
+	if state := approve("bob"); state != (approvalState{Approvers: 2, Quorum: 2, Approved: true}) {
+		t.Errorf("bob's vote: got %#v", state)
+	}
+
+	if !check() {
+		t.Error("not approved at quorum")
+	}
+
+	// Duplicate vote rows by the same approver mustn't count twice either.
+	_, errExec := db.Exec(
+		`INSERT INTO approval_vote(agent, package, from_version, to_version, action, approver, ctime)
+SELECT agent, package, from_version, to_version, action, approver, ? FROM approval_vote WHERE approver='alice'`,
+		time.Now().Unix(),
+	)
+	if errExec != nil {
+		t.Fatal(errExec)
+	}
+
+	if _, errExec := db.Exec(`DELETE FROM approval_vote WHERE approver='bob'`); errExec != nil {
+		t.Fatal(errExec)
+	}
+
+	if check() {
+		t.Error("approved by duplicate votes of one approver")
+	}
+}
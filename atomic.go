@@ -0,0 +1,21 @@
+package main
+
+import "path"
+
+// atomicAgents are patterns of agents whose tasks are approved all together or not at all.
+var atomicAgents []string = nil
+
+var atomicHeldSets = metricsRegisterCounter(
+	"held_task_sets_total", "Task sets held back as not all of their tasks are approved",
+)
+
+// atomicFor tells whether agent's tasks are approved all together or not at all.
+func atomicFor(agent string) bool {
+	for _, pattern := range atomicAgents {
+		if matches, _ := path.Match(pattern, agent); matches {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/masif-upgrader/common"
+	"testing"
+)
+
+func TestAtomicHeldTasks(t *testing.T) {
+	testDb(t)
+
+	atomicAgents = []string{"db*"}
+	webhooks = map[string]*webhook{"test": {name: "test", url: "http://127.0.0.1:1", events: webhookEvents}}
+
+	defer func() {
+		atomicAgents = nil
+		webhooks = map[string]*webhook{}
+	}()
+
+	nginx := common.PkgMgrTask{PackageName: "nginx", FromVersion: "1", ToVersion: "2", Action: common.PkgMgrUpdate}
+	zsh := common.PkgMgrTask{PackageName: "zsh", Action: common.PkgMgrInstall}
+	tasks := map[common.PkgMgrTask]struct{}{nginx: {}, zsh: {}}
+
+	poll := func() map[common.PkgMgrTask]*taskStatus {
+		statuses, errUPT := dbUpdatePendingTasks(context.Background(), "db01", tasks)
+		if errUPT != nil {
+			t.Fatal(errUPT)
+		}
+
+		return statuses
+	}
+
+	approve := func(task common.PkgMgrTask) {
+		errTx := dbTx(context.Background(), "alice", func(tx *sql.Tx) error {
+			_, errAp := dbApprove(tx, "alice", "db01", task)
+			return errAp
+		})
+		if errTx != nil {
+			t.Fatal(errTx)
+		}
+	}
+
+	explainNginx := func() (result *explanation) {
+		errTx := dbTx(context.Background(), "", func(tx *sql.Tx) (err error) {
+			result, err = dbExplain(tx, "db01", nginx)
+			return
+		})
+		if errTx != nil {
+			t.Fatal(errTx)
+		}
+
+		return
+	}
+
+	approvedEvents := func() int64 {
+		return testDbCount(t, `SELECT COUNT(*) FROM webhook_outbox WHERE event=?`, webhookTaskApproved)
+	}
+
+	poll()
+	approve(nginx)
+
+	if statuses := poll(); statuses[nginx].Status != taskHeld || statuses[zsh].Status != taskPending {
+		t.Errorf("got %s and %s, want %s and %s", statuses[nginx].Status, statuses[zsh].Status, taskHeld, taskPending)
+	}
+
+	if events := approvedEvents(); events != 0 {
+		t.Errorf("%d task.approved events for held tasks", events)
+	}
+
+	if pending := testDbCount(t, `SELECT COUNT(*) FROM task WHERE approved=0`); pending != 2 {
+		t.Errorf("%d pending tasks, want the held one still pending, too", pending)
+	}
+
+	if blocking := testDbCount(t, `SELECT COUNT(*) FROM task WHERE approved=0 AND blocking=1`); blocking != 1 {
+		t.Errorf("%d blocking tasks, want 1", blocking)
+	}
+
+	// Nobody in particular has changed which tasks are blocking.
+	if updates := testDbCount(t, `SELECT COUNT(*) FROM audit WHERE event='task_update'`); updates != 0 {
+		t.Errorf("%d task_update audit events", updates)
+	}
+
+	if result := explainNginx(); !result.Approved || !result.Held || result.Blocking != 1 {
+		t.Errorf("got explanation %#v, want held back by one task", result)
+	}
+
+	approve(zsh)
+
+	if statuses := poll(); statuses[nginx].Status != taskApproved || statuses[zsh].Status != taskApproved {
+		t.Errorf("got %s and %s, want both %s", statuses[nginx].Status, statuses[zsh].Status, taskApproved)
+	}
+
+	if events := approvedEvents(); events != 2 {
+		t.Errorf("%d task.approved events on hand-out, want 2", events)
+	}
+
+	if result := explainNginx(); !result.Approved || result.Held || result.Blocking != 0 {
+		t.Errorf("got explanation %#v, want approved", result)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const auditDefaultLimit = 1000
+const auditMaxLimit = 10000
+
+type auditEntry struct {
+	Id          int64           `json:"id"`
+	Time        int64           `json:"time"`
+	Actor       *string         `json:"actor"`
+	Event       string          `json:"event"`
+	Agent       *string         `json:"agent"`
+	Package     *string         `json:"package"`
+	FromVersion *string         `json:"from_version"`
+	ToVersion   *string         `json:"to_version"`
+	Action      *string         `json:"action"`
+	Before      json.RawMessage `json:"before"`
+	After       json.RawMessage `json:"after"`
+}
+
+// adminV1Audit lists audit trail entries, optionally filtered by agent, package and time range.
+func adminV1Audit(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := request.URL.Query()
+	filters := []string{"1=?"}
+	values := []interface{}{1}
+
+	for _, filter := range []string{"agent", "package"} {
+		if value := query.Get(filter); value != "" {
+			filters = append(filters, filter+"=?")
+			values = append(values, value)
+		}
+	}
+
+	for filter, condition := range map[string]string{"since": "time>=?", "until": "time<=?"} {
+		if value := query.Get(filter); value != "" {
+			timestamp, errPI := strconv.ParseInt(value, 10, 64)
+			if errPI != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				writer.Write([]byte("bad " + filter))
+				return
+			}
+
+			filters = append(filters, condition)
+			values = append(values, timestamp)
+		}
+	}
+
+	limit := int64(auditDefaultLimit)
+
+	if rawLimit := query.Get("limit"); rawLimit != "" {
+		var errPI error
+		if limit, errPI = strconv.ParseInt(rawLimit, 10, 64); errPI != nil || limit < 1 || limit > auditMaxLimit {
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write([]byte("bad limit"))
+			return
+		}
+	}
+
+	var entries []auditEntry
+
+	errTx := dbReadTx(request.Context(), adminActor(request), func(tx *sql.Tx) error {
+		rows, errQuery := dbQuery(
+			tx,
+			`
+SELECT id, time, actor, event, agent, package, from_version, to_version, action, before_value, after_value
+FROM audit
+WHERE `+strings.Join(filters, " AND ")+`
+ORDER BY id DESC
+LIMIT `+strconv.FormatInt(limit, 10),
+			values...,
+		)
+		if errQuery != nil {
+			return errQuery
+		}
+
+		entries = make([]auditEntry, 0, len(rows))
+
+		for _, row := range rows {
+			entry := auditEntry{
+				Id:          dbInt(row[0]),
+				Time:        dbInt(row[1]),
+				Actor:       dbNullableString(row[2]),
+				Event:       string(row[3].([]byte)),
+				Agent:       dbNullableString(row[4]),
+				Package:     dbNullableString(row[5]),
+				FromVersion: dbNullableString(row[6]),
+				ToVersion:   dbNullableString(row[7]),
+				Action:      dbNullableString(row[8]),
+			}
+
+			if row[9] != nil {
+				entry.Before = row[9].([]byte)
+			}
+
+			if row[10] != nil {
+				entry.After = row[10].([]byte)
+			}
+
+			entries = append(entries, entry)
+		}
+
+		return nil
+	})
+	if errTx != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	adminRespond(writer, entries)
+}
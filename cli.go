@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/masif-upgrader/common"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"os"
+)
+
+// cliCommands are the operator commands the master runs instead of serving if given after the flags.
+var cliCommands = map[string]func(cfg *settings, args []string) error{
+	"explain":  cliExplain,
+	"simulate": cliSimulate,
+}
+
+// runCli runs the command args[0] with the arguments args[1:] against the database configured in cfg.
+func runCli(cfg *settings, args []string) error {
+	command, commandValid := cliCommands[args[0]]
+	if !commandValid {
+		return errors.New("bad command: " + args[0])
+	}
+
+	log.SetOutput(os.Stderr)
+
+	var errDB error
+	if db, errDB = sql.Open(cfg.db.typ, cfg.db.dsn); errDB != nil {
+		return errDB
+	}
+
+	if cfg.db.replicaDsn != "" {
+		if replica, errDB = sql.Open(cfg.db.typ, cfg.db.replicaDsn); errDB != nil {
+			return errDB
+		}
+	}
+
+	dbConfigure(cfg)
+	quorums = cfg.quorums
+
+	return command(cfg, args[1:])
+}
+
+// cliPrint writes result as indented JSON to stdout.
+func cliPrint(result interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "\t")
+
+	return encoder.Encode(result)
+}
+
+func cliExplain(_ *settings, args []string) error {
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent")
+	pkg := flags.String("package", "", "package")
+	action := flags.String("action", "", "install, update, configure, remove or purge")
+	fromVersion := flags.String("from", "", "from version")
+	toVersion := flags.String("to", "", "to version")
+
+	if errFP := flags.Parse(args); errFP != nil {
+		return errFP
+	}
+
+	var task common.PkgMgrTask
+	var errEPT error
+
+	if *agent, task, errEPT = explainParseTask(url.Values{
+		"agent":        {*agent},
+		"package":      {*pkg},
+		"action":       {*action},
+		"from_version": {*fromVersion},
+		"to_version":   {*toVersion},
+	}); errEPT != nil {
+		return errEPT
+	}
+
+	var result *explanation
+
+	if errTx := dbReadTx(context.Background(), "cli", func(tx *sql.Tx) (err error) {
+		result, err = dbExplain(tx, *agent, task)
+		return
+	}); errTx != nil {
+		return errTx
+	}
+
+	return cliPrint(result)
+}
+
+func cliSimulate(_ *settings, args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent (default: all)")
+	pkg := flags.String("package", "", "package (default: any)")
+	action := flags.String("action", "", "install, update, configure, remove or purge (default: any)")
+	fromVersion := flags.String("from", "", "from version (default: any)")
+	toVersion := flags.String("to", "", "to version (default: any)")
+
+	if errFP := flags.Parse(args); errFP != nil {
+		return errFP
+	}
+
+	rule, errART := approvalRuleTask(*pkg, *fromVersion, *toVersion, *action)
+	if errART != nil {
+		return errART
+	}
+
+	var result *simulation
+
+	if errTx := dbReadTx(context.Background(), "cli", func(tx *sql.Tx) (err error) {
+		result, err = dbSimulate(tx, *agent, rule)
+		return
+	}); errTx != nil {
+		return errTx
+	}
+
+	return cliPrint(result)
+}
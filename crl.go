@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const crlPollInterval = 10 * time.Second
+
+var apiRevoked = errors.New("all valid certificates directly below root have been revoked")
+
+var crlBadSignature = errors.New("CRL isn't signed by any trusted CA")
+
+var crlReloads = metricsRegisterCounter("crl_reloads_total", "Successful CRL (re-)loads")
+var crlReloadErrors = metricsRegisterCounter("crl_reload_errors_total", "Failed CRL (re-)loads")
+
+type crlFileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+type crlStore struct {
+	path string
+	cas  []*x509.Certificate
+
+	mutex        sync.RWMutex
+	crl          *pkix.CertificateList
+	revokedCerts map[string]struct{}
+
+	// lastSeen is only accessed by the watcher.
+	lastSeen      crlFileStamp
+	expiredWarned bool
+}
+
+// newCrlStore loads the CRL at path which must be signed by one of cas.
+func newCrlStore(path string, cas []*x509.Certificate) (*crlStore, error) {
+	store := &crlStore{path: path, cas: cas}
+
+	log.WithFields(log.Fields{"crl": path}).Info("Initially loading CRL")
+
+	stamp, errSt := crlStat(path)
+	if errSt != nil {
+		return nil, errSt
+	}
+
+	if errLd := store.load(); errLd != nil {
+		return nil, errLd
+	}
+
+	store.lastSeen = stamp
+
+	metricsRegisterGauge(
+		"crl_this_update_timestamp_seconds", "The loaded CRL's thisUpdate",
+		func() float64 { return float64(store.current().TBSCertList.ThisUpdate.Unix()) },
+	)
+
+	metricsRegisterGauge(
+		"crl_next_update_timestamp_seconds", "The loaded CRL's nextUpdate",
+		func() float64 { return float64(store.current().TBSCertList.NextUpdate.Unix()) },
+	)
+
+	return store, nil
+}
+
+func crlStat(path string) (crlFileStamp, error) {
+	stats, errStat := os.Stat(path)
+	if errStat != nil {
+		return crlFileStamp{}, errStat
+	}
+
+	return crlFileStamp{stats.ModTime(), stats.Size()}, nil
+}
+
+func (s *crlStore) current() *pkix.CertificateList {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.crl
+}
+
+// load reads, parses and verifies the CRL file and swaps it in only if all of that succeeded.
+func (s *crlStore) load() error {
+	rawCRL, errRF := ioutil.ReadFile(s.path)
+	if errRF != nil {
+		crlReloadErrors.inc()
+		return errRF
+	}
+
+	freshCRL, errPCRL := x509.ParseCRL(rawCRL)
+	if errPCRL != nil {
+		crlReloadErrors.inc()
+		return errPCRL
+	}
+
+	signed := false
+	for _, ca := range s.cas {
+		if ca.CheckCRLSignature(freshCRL) == nil {
+			signed = true
+			break
+		}
+	}
+
+	if !signed {
+		crlReloadErrors.inc()
+		return crlBadSignature
+	}
+
+	revokedCerts := map[string]struct{}{}
+	for _, revokedCert := range freshCRL.TBSCertList.RevokedCertificates {
+		revokedCerts[revokedCert.SerialNumber.Text(16)] = struct{}{}
+	}
+
+	s.mutex.Lock()
+	s.crl = freshCRL
+	s.revokedCerts = revokedCerts
+	s.mutex.Unlock()
+
+	s.expiredWarned = false
+	crlReloads.inc()
+
+	log.WithFields(log.Fields{
+		"crl":         s.path,
+		"this_update": freshCRL.TBSCertList.ThisUpdate,
+		"next_update": freshCRL.TBSCertList.NextUpdate,
+		"revoked":     len(revokedCerts),
+	}).Info("Loaded CRL")
+
+	return nil
+}
+
+// watch polls the CRL file for changes and re-loads it immediately on change.
+// On errors the previously loaded CRL stays in effect.
+func (s *crlStore) watch() {
+	for {
+		time.Sleep(crlPollInterval)
+
+		if crl := s.current(); !s.expiredWarned && crl.HasExpired(time.Now()) {
+			log.WithFields(log.Fields{
+				"crl": s.path, "next_update": crl.TBSCertList.NextUpdate,
+			}).Warn("CRL has expired, but hasn't been updated, keeping it")
+
+			s.expiredWarned = true
+		}
+
+		stamp, errSt := crlStat(s.path)
+		if errSt != nil {
+			log.WithFields(log.Fields{"crl": s.path, "error": errSt}).Error("Couldn't stat CRL")
+			continue
+		}
+
+		if stamp == s.lastSeen {
+			continue
+		}
+
+		s.lastSeen = stamp
+
+		log.WithFields(log.Fields{"crl": s.path}).Info("CRL has changed, re-loading")
+
+		if errLd := s.load(); errLd != nil {
+			log.WithFields(log.Fields{"crl": s.path, "error": errLd}).Error("Couldn't re-load CRL, keeping the old one")
+		}
+	}
+}
+
+func (s *crlStore) validator() func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		log.Debug("Checking the remote's TLS certificate chain for at least one non-revoked path")
+
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+
+		for _, chains := range verifiedChains {
+			if chains[len(chains)-1].CheckCRLSignature(s.crl) == nil {
+				if _, isRevoked := s.revokedCerts[chains[len(chains)-2].SerialNumber.Text(16)]; !isRevoked {
+					log.Debug("Found non-revoked path in the remote's TLS certificate chain")
+
+					return nil
+				}
+			}
+		}
+
+		log.Warn("Didn't find any non-revoked path in the remote's TLS certificate chain")
+
+		return apiRevoked
+	}
+}
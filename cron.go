@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule tells when a job is due.
+type cronSchedule interface {
+	// next returns the first due time after t.
+	next(t time.Time) time.Time
+}
+
+// cronEvery is due every interval, e.g. "@every 5s".
+type cronEvery time.Duration
+
+func (c cronEvery) next(t time.Time) time.Time {
+	return t.Add(time.Duration(c))
+}
+
+// cronFields is a classic cron expression like "30 8 * * 1-5" as sets of allowed values.
+type cronFields struct {
+	minute, hour, dom, month, dow map[int]struct{}
+	// domAny and dowAny tell whether the day of month or week hasn't been restricted.
+	domAny, dowAny bool
+}
+
+// cronMaxLookahead limits the search for the next due time of expressions like "0 0 30 2 *".
+const cronMaxLookahead = 4 * 366 * 24 * time.Hour
+
+func (c *cronFields) next(t time.Time) time.Time {
+	next := t.Truncate(time.Minute).Add(time.Minute)
+
+	for limit := t.Add(cronMaxLookahead); next.Before(limit); {
+		if c.skipped(next) {
+			return next
+		}
+
+		if _, ok := c.month[int(next.Month())]; !ok {
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+
+		if !c.day(next) {
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+
+		if _, ok := c.hour[next.Hour()]; !ok {
+			next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, next.Location())
+			continue
+		}
+
+		if _, ok := c.minute[next.Minute()]; !ok {
+			next = next.Add(time.Minute)
+			continue
+		}
+
+		return next
+	}
+
+	return time.Time{}
+}
+
+// skipped tells whether t is the first minute after the clocks have been set forward
+// and a due time fell into the gap. Such a run is made up for at t.
+func (c *cronFields) skipped(t time.Time) bool {
+	_, offsetBefore := t.Add(-time.Minute).Zone()
+	_, offset := t.Zone()
+
+	if offset <= offsetBefore {
+		return false
+	}
+
+	// The wall clock times in the gap, in UTC not to be normalized again
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+
+	for skipped := wall.Add(-time.Duration(offset-offsetBefore) * time.Second); skipped.Before(wall); {
+		if c.matches(skipped) {
+			return true
+		}
+
+		skipped = skipped.Add(time.Minute)
+	}
+
+	return false
+}
+
+// matches tells whether t's wall clock time is due.
+func (c *cronFields) matches(t time.Time) bool {
+	_, month := c.month[int(t.Month())]
+	_, hour := c.hour[t.Hour()]
+	_, minute := c.minute[t.Minute()]
+
+	return month && hour && minute && c.day(t)
+}
+
+// day tells whether t's day is allowed. Like in cron, if both the day of month and week are restricted,
+// either has to match.
+func (c *cronFields) day(t time.Time) bool {
+	_, dom := c.dom[t.Day()]
+	_, dow := c.dow[int(t.Weekday())]
+
+	switch {
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+var cronMacros = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// cronParse parses a cron expression with five fields (minute, hour, day of month, month, day of week),
+// one of the macros like "@daily" or "@every DURATION".
+func cronParse(expr string) (cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+
+	if rawInterval := strings.TrimPrefix(expr, "@every "); rawInterval != expr {
+		interval, errPD := time.ParseDuration(strings.TrimSpace(rawInterval))
+		if errPD != nil || interval <= 0 {
+			return nil, errors.New("bad interval: " + rawInterval)
+		}
+
+		return cronEvery(interval), nil
+	}
+
+	if macro, isMacro := cronMacros[expr]; isMacro {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression must have five fields")
+	}
+
+	schedule := &cronFields{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+
+	for i, field := range []struct {
+		values   *map[int]struct{}
+		min, max int
+	}{
+		{&schedule.minute, 0, 59},
+		{&schedule.hour, 0, 23},
+		{&schedule.dom, 1, 31},
+		{&schedule.month, 1, 12},
+		{&schedule.dow, 0, 7},
+	} {
+		values, errPF := cronParseField(fields[i], field.min, field.max)
+		if errPF != nil {
+			return nil, errPF
+		}
+
+		*field.values = values
+	}
+
+	// Both 0 and 7 mean Sunday.
+	if _, hasSeven := schedule.dow[7]; hasSeven {
+		schedule.dow[0] = struct{}{}
+	}
+
+	return schedule, nil
+}
+
+// cronParseField parses a comma-separated list of "*", "N" or "N-M", each optionally followed by "/STEP".
+func cronParseField(field string, min, max int) (map[int]struct{}, error) {
+	values := map[int]struct{}{}
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			var errAtoi error
+			if step, errAtoi = strconv.Atoi(part[slash+1:]); errAtoi != nil || step < 1 {
+				return nil, errors.New("bad step: " + part)
+			}
+
+			part = part[:slash]
+		}
+
+		from, to := min, max
+
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			var errAtoi error
+			if from, errAtoi = strconv.Atoi(bounds[0]); errAtoi != nil {
+				return nil, errors.New("bad value: " + part)
+			}
+
+			to = from
+
+			if len(bounds) > 1 {
+				if to, errAtoi = strconv.Atoi(bounds[1]); errAtoi != nil {
+					return nil, errors.New("bad value: " + part)
+				}
+			} else if step > 1 {
+				to = max
+			}
+
+			if from < min || to > max || from > to {
+				return nil, errors.New("value out of range: " + part)
+			}
+		}
+
+		for value := from; value <= to; value += step {
+			values[value] = struct{}{}
+		}
+	}
+
+	return values, nil
+}
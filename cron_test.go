@@ -0,0 +1,212 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCronValues formats a field's allowed values like "0,15,30,45".
+func testCronValues(values map[int]struct{}) string {
+	sorted := make([]int, 0, len(values))
+	for value := range values {
+		sorted = append(sorted, value)
+	}
+
+	sort.Ints(sorted)
+
+	formatted := make([]string, 0, len(sorted))
+	for _, value := range sorted {
+		formatted = append(formatted, strconv.Itoa(value))
+	}
+
+	return strings.Join(formatted, ",")
+}
+
+func TestCronParse(t *testing.T) {
+	cases := []struct {
+		expr string
+		// The fields' allowed values, empty ones aren't checked.
+		minute, hour, dom, month, dow string
+		domAny, dowAny                bool
+	}{
+		{expr: "30 8 * * 1-5", minute: "30", hour: "8", month: "1,2,3,4,5,6,7,8,9,10,11,12", dow: "1,2,3,4,5", domAny: true},
+		{expr: "*/15 * * * *", minute: "0,15,30,45", domAny: true, dowAny: true},
+		{expr: "5-20/5 * * * *", minute: "5,10,15,20", domAny: true, dowAny: true},
+		{expr: "10/20 */6 * * *", minute: "10,30,50", hour: "0,6,12,18", domAny: true, dowAny: true},
+		{expr: "0,30 1,2,5-7 1,15 * *", minute: "0,30", hour: "1,2,5,6,7", dom: "1,15", dowAny: true},
+		{expr: "0 0 * 1-12/3 0", month: "1,4,7,10", dow: "0", domAny: true},
+		{expr: "0 0 * * 7", dow: "0,7", domAny: true},
+		{expr: "0 0 13 * 5", dom: "13", dow: "5"},
+		{expr: "  59 23 31 12 6  ", minute: "59", hour: "23", dom: "31", month: "12", dow: "6"},
+		{expr: "@yearly", minute: "0", hour: "0", dom: "1", month: "1", dowAny: true},
+		{expr: "@weekly", minute: "0", hour: "0", dow: "0", domAny: true},
+		{expr: "@hourly", minute: "0", domAny: true, dowAny: true},
+	}
+
+	for _, c := range cases {
+		schedule, errCP := cronParse(c.expr)
+		if errCP != nil {
+			t.Errorf("%q: %s", c.expr, errCP.Error())
+			continue
+		}
+
+		fields, ok := schedule.(*cronFields)
+		if !ok {
+			t.Errorf("%q: got %#v, want fields", c.expr, schedule)
+			continue
+		}
+
+		for _, field := range []struct {
+			name   string
+			values map[int]struct{}
+			want   string
+		}{
+			{"minute", fields.minute, c.minute},
+			{"hour", fields.hour, c.hour},
+			{"day of month", fields.dom, c.dom},
+			{"month", fields.month, c.month},
+			{"day of week", fields.dow, c.dow},
+		} {
+			if got := testCronValues(field.values); field.want != "" && got != field.want {
+				t.Errorf("%q: got %s %s, want %s", c.expr, field.name, got, field.want)
+			}
+		}
+
+		if fields.domAny != c.domAny || fields.dowAny != c.dowAny {
+			t.Errorf(
+				"%q: got any day of month/week %t/%t, want %t/%t",
+				c.expr, fields.domAny, fields.dowAny, c.domAny, c.dowAny,
+			)
+		}
+	}
+
+	if schedule, errCP := cronParse("@every 1m30s"); errCP != nil || schedule != cronEvery(90*time.Second) {
+		t.Errorf("@every 1m30s: got %#v and %v", schedule, errCP)
+	}
+
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"-1 * * * *",
+		"5-1 * * * *",
+		"1-70 * * * *",
+		"*/0 * * * *",
+		"*/-5 * * * *",
+		"*/ * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-a * * * *",
+		"*-5 * * * *",
+		"1,,2 * * * *",
+		"@sometimes",
+		"@every",
+		"@every ",
+		"@every x",
+		"@every 0s",
+		"@every -1m",
+	} {
+		if schedule, errCP := cronParse(expr); errCP == nil {
+			t.Errorf("%q: got %#v, want an error", expr, schedule)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	berlin, errLL := time.LoadLocation("Europe/Berlin")
+	if errLL != nil {
+		t.Skip(errLL.Error())
+	}
+
+	cases := []struct {
+		name, expr string
+		loc        *time.Location
+		from, want string
+	}{
+		{name: "within the hour", expr: "*/15 * * * *", from: "2021-06-04 10:07:30", want: "2021-06-04 10:15"},
+		{name: "strictly after", expr: "@hourly", from: "2021-06-04 10:00", want: "2021-06-04 11:00"},
+		{name: "next day", expr: "0 0 * * *", from: "2021-06-04 23:59:59", want: "2021-06-05 00:00"},
+		{name: "over the weekend", expr: "30 8 * * 1-5", from: "2021-06-04 08:30", want: "2021-06-07 08:30"},
+		{name: "Sunday as 7", expr: "0 12 * * 7", from: "2021-06-04 00:00", want: "2021-06-06 12:00"},
+		{name: "day of month or week", expr: "0 0 13 * 5", from: "2021-06-01 00:00", want: "2021-06-04 00:00"},
+		{name: "day of month or week again", expr: "0 0 13 * 5", from: "2021-08-07 00:00", want: "2021-08-13 00:00"},
+		{name: "next month", expr: "0 0 1 * *", from: "2021-06-04 00:00", want: "2021-07-01 00:00"},
+		{name: "next year", expr: "@yearly", from: "2021-06-04 00:00", want: "2022-01-01 00:00"},
+		{name: "leap day", expr: "0 0 29 2 *", from: "2021-03-01 00:00", want: "2024-02-29 00:00"},
+		{name: "never", expr: "0 0 30 2 *", from: "2021-03-01 00:00"},
+		{name: "interval", expr: "@every 90s", from: "2021-06-04 10:00:10", want: "2021-06-04 10:01:40"},
+		{name: "local time", expr: "30 8 * * *", loc: berlin, from: "2021-06-04 09:00", want: "2021-06-05 08:30"},
+		{
+			name: "in the DST gap", expr: "30 2 * * *", loc: berlin,
+			from: "2021-03-28 01:00", want: "2021-03-28 03:00",
+		},
+		{
+			name: "after the DST gap", expr: "30 2 * * *", loc: berlin,
+			from: "2021-03-28 03:00", want: "2021-03-29 02:30",
+		},
+		{
+			name: "the day before the DST gap", expr: "30 2 * * *", loc: berlin,
+			from: "2021-03-27 03:00", want: "2021-03-28 03:00",
+		},
+		{
+			name: "every minute in the DST gap", expr: "* 2 * * *", loc: berlin,
+			from: "2021-03-28 01:59", want: "2021-03-28 03:00",
+		},
+		{
+			name: "hourly over the DST gap", expr: "@hourly", loc: berlin,
+			from: "2021-03-28 01:00", want: "2021-03-28 03:00",
+		},
+		{
+			name: "after the DST gap anyway", expr: "15 3 * * *", loc: berlin,
+			from: "2021-03-28 01:00", want: "2021-03-28 03:15",
+		},
+		{
+			name: "other day than the DST gap", expr: "30 2 * * 1", loc: berlin,
+			from: "2021-03-28 01:00", want: "2021-03-29 02:30",
+		},
+	}
+
+	parse := func(raw string, loc *time.Location) time.Time {
+		layout := "2006-01-02 15:04"
+		if strings.Count(raw, ":") > 1 {
+			layout += ":05"
+		}
+
+		parsed, errPIL := time.ParseInLocation(layout, raw, loc)
+		if errPIL != nil {
+			t.Fatal(errPIL)
+		}
+
+		return parsed
+	}
+
+	for _, c := range cases {
+		if c.loc == nil {
+			c.loc = time.UTC
+		}
+
+		schedule, errCP := cronParse(c.expr)
+		if errCP != nil {
+			t.Fatalf("%s: %s", c.name, errCP.Error())
+		}
+
+		var want time.Time
+		if c.want != "" {
+			want = parse(c.want, c.loc)
+		}
+
+		if got := schedule.next(parse(c.from, c.loc)); !got.Equal(want) {
+			t.Errorf("%s: got %s, want %s", c.name, got, want)
+		}
+	}
+}
@@ -2,17 +2,31 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/masif-upgrader/common"
 	"github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"math/rand"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// dbConflict says that a concurrent transaction got in the way and the transaction should be retried.
+var dbConflict = errors.New("concurrent change")
+
 func isRecoverableDbError(e error) bool {
+	if e == dbConflict {
+		return true
+	}
+
 	switch errDb := e.(type) {
 	case *mysql.MySQLError:
 		switch errDb.Number {
@@ -26,32 +40,197 @@ func isRecoverableDbError(e error) bool {
 	}
 }
 
-func dbTx(f func(tx *sql.Tx) error) error {
-	log.Debug("Starting transaction")
+// isAppliedDdlError tells whether e just says that a schema change has already been made.
+func isAppliedDdlError(e error) bool {
+	if errDb, ok := e.(*mysql.MySQLError); ok {
+		switch errDb.Number {
+		case 1060, 1061, 1359:
+			return true
+		}
+	}
+
+	return false
+}
+
+// isDuplicateDbError tells whether e says that a row with the same unique key already exists.
+func isDuplicateDbError(e error) bool {
+	errDb, ok := e.(*mysql.MySQLError)
+	return ok && errDb.Number == 1062
+}
+
+// dbInt converts an integer column's value which may be represented as text by the driver.
+func dbInt(value interface{}) int64 {
+	switch v := value.(type) {
+	case int64:
+		return v
+	case []byte:
+		i, _ := strconv.ParseInt(string(v), 10, 64)
+		return i
+	default:
+		return 0
+	}
+}
+
+// dbMaxRetries limits how often dbTx retries a transaction.
+var dbMaxRetries = 10
+
+const (
+	dbBackoffMin = 10 * time.Millisecond
+	dbBackoffMax = 2 * time.Second
+)
+
+var dbTxRetries = metricsRegisterCounter("db_transaction_retries_total", "Retried database transactions")
+var dbTxFailures = metricsRegisterCounter("db_transaction_failures_total", "Failed database transactions")
+
+// dbBackoff returns a random delay up to dbBackoffMin*2^attempt, but not more than dbBackoffMax.
+func dbBackoff(attempt int) time.Duration {
+	max := dbBackoffMax
+	if attempt < 16 && dbBackoffMin<<uint(attempt) < max {
+		max = dbBackoffMin << uint(attempt)
+	}
+
+	return time.Duration(rand.Int63n(int64(max)) + 1)
+}
+
+// dbSleep waits for d unless ctx is done before.
+func dbSleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dbQueryTimeout limits how long a single statement may take, zero means no limit.
+var dbQueryTimeout time.Duration = 0
 
-	for {
-		errTx := dbTryTx(f)
+// dbConfigure applies cfg's connection pool and retry settings to the opened db (and replica).
+func dbConfigure(cfg *settings) {
+	for _, pool := range []*sql.DB{db, replica} {
+		if pool != nil {
+			pool.SetMaxOpenConns(cfg.db.maxOpenConns)
+			pool.SetMaxIdleConns(cfg.db.maxIdleConns)
+			pool.SetConnMaxLifetime(cfg.db.connMaxLifetime)
+		}
+	}
+
+	replicaMaxLag = cfg.db.replicaMaxLag
+
+	dbMaxRetries = cfg.db.maxRetries
+	dbQueryTimeout = cfg.db.queryTimeout
+}
+
+// dbStatementContext returns a context for a single statement limited by dbQueryTimeout.
+func dbStatementContext() (context.Context, context.CancelFunc) {
+	if dbQueryTimeout > 0 {
+		return context.WithTimeout(context.Background(), dbQueryTimeout)
+	}
+
+	return context.Background(), func() {}
+}
+
+// dbTx runs f in a transaction, retrying it on recoverable errors with backoff up to dbMaxRetries times
+// unless ctx is done.
+// actor is recorded in the audit trail for changes made by f, empty if nobody in particular.
+func dbTx(ctx context.Context, actor string, f func(tx *sql.Tx) error) error {
+	return dbTxWith(ctx, sql.LevelSerializable, actor, f)
+}
+
+// dbTxWith is like dbTx, but runs f at the given isolation level.
+func dbTxWith(ctx context.Context, isolation sql.IsolationLevel, actor string, f func(tx *sql.Tx) error) error {
+	log.WithFields(log.Fields{"actor": actor, "isolation": isolation}).Debug("Starting transaction")
+
+	for attempt := 0; ; attempt++ {
+		errTx := dbTryTx(ctx, isolation, actor, f)
 		if errTx == nil {
 			log.Debug("Transaction succeeded")
 		} else {
-			if isRecoverableDbError(errTx) {
-				log.WithFields(log.Fields{"error": errTx}).Warn("Retrying transaction")
-				continue
+			if isRecoverableDbError(errTx) && attempt < dbMaxRetries {
+				backoff := dbBackoff(attempt)
+
+				log.WithFields(log.Fields{
+					"actor": actor, "error": errTx, "attempt": attempt + 1, "backoff": backoff,
+				}).Warn("Retrying transaction")
+
+				dbTxRetries.inc()
+
+				if errSl := dbSleep(ctx, backoff); errSl != nil {
+					errTx = errSl
+				} else {
+					continue
+				}
 			}
 
-			log.WithFields(log.Fields{"error": errTx}).Error("Transaction failed")
+			dbTxFailures.inc()
+			log.WithFields(log.Fields{"actor": actor, "error": errTx, "attempts": attempt + 1}).Error("Transaction failed")
 		}
 
 		return errTx
 	}
 }
 
-func dbTryTx(f func(tx *sql.Tx) error) error {
-	tx, errBT := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+// dbLoadSchema applies the SQL schema, waiting for the database to become available for up to timeout.
+func dbLoadSchema(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		errPing := db.PingContext(ctx)
+		if errPing == nil {
+			break
+		}
+
+		backoff := dbBackoff(attempt)
+		log.WithFields(log.Fields{"error": errPing, "backoff": backoff}).Warn("Waiting for database")
+
+		if errSl := dbSleep(ctx, backoff); errSl != nil {
+			return errPing
+		}
+	}
+
+	for _, ddl := range mysqlDdls {
+		log.WithFields(log.Fields{"sql": ddl}).Debug("Changing database schema")
+
+		for attempt := 0; ; attempt++ {
+			if _, errExec := db.ExecContext(ctx, ddl); errExec != nil {
+				if isAppliedDdlError(errExec) {
+					break
+				}
+
+				if isRecoverableDbError(errExec) {
+					if errSl := dbSleep(ctx, dbBackoff(attempt)); errSl != nil {
+						return errExec
+					}
+
+					continue
+				}
+
+				return errExec
+			}
+
+			break
+		}
+	}
+
+	return nil
+}
+
+func dbTryTx(ctx context.Context, isolation sql.IsolationLevel, actor string, f func(tx *sql.Tx) error) error {
+	tx, errBT := db.BeginTx(ctx, &sql.TxOptions{Isolation: isolation})
 	if errBT != nil {
 		return errBT
 	}
 
+	// Connections are re-used, so always overwrite the previous transaction's actor.
+	if _, errExec := dbExec(tx, `SET @masif_actor=?`, dbNullString(actor)); errExec != nil {
+		tx.Rollback()
+		return errExec
+	}
+
 	if errTx := f(tx); errTx != nil {
 		tx.Rollback()
 		return errTx
@@ -63,11 +242,16 @@ func dbTryTx(f func(tx *sql.Tx) error) error {
 func dbQuery(tx *sql.Tx, query string, args ...interface{}) (result [][]interface{}, err error) {
 	log.WithFields(log.Fields{"sql": query, "params": args}).Debug("Querying database")
 
-	rows, errQuery := tx.Query(query, args...)
+	ctx, cancel := dbStatementContext()
+	defer cancel()
+
+	rows, errQuery := tx.QueryContext(ctx, query, args...)
 	if errQuery != nil {
 		return nil, errQuery
 	}
 
+	defer rows.Close()
+
 	types, errCT := rows.ColumnTypes()
 	if errCT != nil {
 		return nil, errCT
@@ -90,13 +274,22 @@ func dbQuery(tx *sql.Tx, query string, args ...interface{}) (result [][]interfac
 		result = append(result, nextRow)
 	}
 
+	err = rows.Err()
 	return
 }
 
-func dbExec(db interface{ Exec(string, ...interface{}) (sql.Result, error) }, query string, args ...interface{}) (sql.Result, error) {
+func dbExec(
+	db interface {
+		ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	},
+	query string, args ...interface{},
+) (sql.Result, error) {
 	log.WithFields(log.Fields{"sql": query, "params": args}).Debug("Changing database")
 
-	return db.Exec(query, args...)
+	ctx, cancel := dbStatementContext()
+	defer cancel()
+
+	return db.ExecContext(ctx, query, args...)
 }
 
 var pkgMgrAction2db = map[common.PkgMgrAction]string{
@@ -107,69 +300,95 @@ var pkgMgrAction2db = map[common.PkgMgrAction]string{
 	common.PkgMgrPurge:     "purge",
 }
 
-func dbUpdatePendingTasks(agent string, tasks map[common.PkgMgrTask]struct{}) (approvedTasks map[common.PkgMgrTask]struct{}, err error) {
-	err = dbTx(func(tx *sql.Tx) error {
-		approvedTasksInDb, errDGT := dbGetTasks(tx, nil, 1)
-		if errDGT != nil {
-			return errDGT
-		}
+// dbAgentIsolation is the isolation level of agent updates which lock only the agent's row.
+var dbAgentIsolation = sql.LevelReadCommitted
 
-		rows, errQuery := dbQuery(tx, `SELECT id FROM agent WHERE name=?`, agent)
+// dbUpdatePendingTasks records tasks as agent's pending ones except the approved ones and tells the status of each.
+func dbUpdatePendingTasks(ctx context.Context, agent string, tasks map[common.PkgMgrTask]struct{}) (statuses map[common.PkgMgrTask]*taskStatus, err error) {
+	var approvedTasks map[common.PkgMgrTask]struct{}
+	var held bool
+
+	// Only this agent's row is locked. Approvals are read as committed, so agents don't get in each other's way.
+	err = dbTxWith(ctx, dbAgentIsolation, "agent:"+agent, func(tx *sql.Tx) error {
+		rows, errQuery := dbQuery(tx, `SELECT id, fingerprint FROM agent WHERE name=? FOR UPDATE`, agent)
 		if errQuery != nil {
 			return errQuery
 		}
 
 		dbHasAgent := len(rows) > 0
 		var dbAgentId int64
+		var dbFingerprint *string
+		var agentKey interface{} = nil
 
 		if dbHasAgent {
 			dbAgentId = rows[0][0].(int64)
+			dbFingerprint = dbNullableString(rows[0][1])
+			agentKey = dbAgentId
+		}
 
-			approvedTasksForAgent, errDGT := dbGetTasks(tx, dbAgentId, 1)
-			if errDGT != nil {
-				return errDGT
-			}
-
-			for task := range approvedTasksForAgent {
-				approvedTasksInDb[task] = struct{}{}
-			}
+		globalApprovals, agentApprovals, errAG := approvals.get(tx, agentKey)
+		if errAG != nil {
+			return errAG
 		}
 
 		approvedTasks = map[common.PkgMgrTask]struct{}{}
 		pendingTasks := map[common.PkgMgrTask]struct{}{}
+		statuses = make(map[common.PkgMgrTask]*taskStatus, len(tasks))
 
-	CheckTask:
 		for task := range tasks {
-			for packageName := range map[string]struct{}{task.PackageName: {}, "": {}} {
-				for fromVersion := range map[string]struct{}{task.FromVersion: {}, "": {}} {
-					for toVersion := range map[string]struct{}{task.ToVersion: {}, "": {}} {
-						for action := range map[common.PkgMgrAction]struct{}{task.Action: {}, 255: {}} {
-							pseudoTask := common.PkgMgrTask{
-								PackageName: packageName,
-								FromVersion: fromVersion,
-								ToVersion:   toVersion,
-								Action:      action,
-							}
-
-							if _, isApproved := approvedTasksInDb[pseudoTask]; isApproved {
-								approvedTasks[task] = struct{}{}
-								continue CheckTask
-							}
-						}
-					}
+			explanation := explain(task, globalApprovals, agentApprovals)
+
+			if explanation.Approved {
+				approvedTasks[task] = struct{}{}
+				statuses[task] = &taskStatus{taskApproved, explanation.Reason}
+			} else {
+				pendingTasks[task] = struct{}{}
+				statuses[task] = &taskStatus{taskPending, explanation.Reason}
+			}
+		}
+
+		atomic := atomicFor(agent)
+		held = atomic && len(approvedTasks) > 0 && len(pendingTasks) > 0
+		fingerprint := pendingTasksFingerprint(approvedTasks, pendingTasks, held)
+
+		if dbFingerprint != nil && *dbFingerprint == fingerprint {
+			pendingTasksUnchanged.inc()
+			return nil
+		}
+
+		pendingTasksWrites.inc()
+
+		var pendingTasksInDb map[common.PkgMgrTask]struct{} = nil
+
+		// Held tasks aren't handed out yet, so they stay pending until they are.
+		if dbHasAgent && !held && webhookSubscribed(webhookTaskApproved) {
+			var errDGT error
+			if pendingTasksInDb, errDGT = dbGetTasks(tx, dbAgentId, 0); errDGT != nil {
+				return errDGT
+			}
+
+			approvedPendingTasks := map[common.PkgMgrTask]struct{}{}
+
+			for task := range approvedTasks {
+				if _, wasPending := pendingTasksInDb[task]; wasPending {
+					approvedPendingTasks[task] = struct{}{}
 				}
 			}
 
-			pendingTasks[task] = struct{}{}
+			if errWE := webhookEnqueue(tx, webhookTaskApproved, agent, approvedPendingTasks); errWE != nil {
+				return errWE
+			}
 		}
 
 		if len(pendingTasks) > 0 {
 			var pendingTasksForDb map[common.PkgMgrTask]struct{}
 
 			if dbHasAgent {
-				pendingTasksInDb, errDGT := dbGetTasks(tx, dbAgentId, 0)
-				if errDGT != nil {
-					return errDGT
+				if pendingTasksInDb == nil {
+					var errDGT error
+					if pendingTasksInDb, errDGT = dbGetTasks(tx, dbAgentId, 0); errDGT != nil {
+						return errDGT
+					}
 				}
 
 				pendingTasksForDb = map[common.PkgMgrTask]struct{}{}
@@ -181,9 +400,11 @@ func dbUpdatePendingTasks(agent string, tasks map[common.PkgMgrTask]struct{}) (a
 				pendingTasksOutDb := map[common.PkgMgrTask]struct{}{}
 
 				for task := range pendingTasksInDb {
+					_, isApproved := approvedTasks[task]
+
 					if _, exists := pendingTasksForDb[task]; exists {
 						delete(pendingTasksForDb, task)
-					} else {
+					} else if !held || !isApproved {
 						pendingTasksOutDb[task] = struct{}{}
 					}
 				}
@@ -196,6 +417,10 @@ func dbUpdatePendingTasks(agent string, tasks map[common.PkgMgrTask]struct{}) (a
 			}
 
 			if len(pendingTasksForDb) > 0 {
+				if errWE := webhookEnqueue(tx, webhookTaskPending, agent, pendingTasksForDb); errWE != nil {
+					return errWE
+				}
+
 				now := time.Now().Unix()
 
 				if dbHasAgent {
@@ -212,6 +437,11 @@ func dbUpdatePendingTasks(agent string, tasks map[common.PkgMgrTask]struct{}) (a
 						now,
 					)
 					if errExec != nil {
+						// Another poll of the same agent has created it in the meantime.
+						if isDuplicateDbError(errExec) {
+							return dbConflict
+						}
+
 						return errExec
 					}
 
@@ -223,74 +453,248 @@ func dbUpdatePendingTasks(agent string, tasks map[common.PkgMgrTask]struct{}) (a
 					dbAgentId = id
 				}
 
-				insertedPackages := map[string]int64{}
+				if errIPT := dbInsertPendingTasks(tx, dbAgentId, pendingTasksForDb, now); errIPT != nil {
+					return errIPT
+				}
+			}
 
-				for task := range pendingTasksForDb {
-					var packageId int64
+			if atomic {
+				var blocking map[common.PkgMgrTask]struct{} = nil
+				if held {
+					blocking = pendingTasks
+				}
 
-					if id, insertedPackage := insertedPackages[task.PackageName]; insertedPackage {
-						packageId = id
-					} else {
-						rows, errQuery := dbQuery(tx, `SELECT id FROM package WHERE name=?`, task.PackageName)
-						if errQuery != nil {
-							return errQuery
-						}
+				if errMB := dbMarkBlocking(tx, dbAgentId, blocking); errMB != nil {
+					return errMB
+				}
+			}
+		} else if dbHasAgent {
+			_, errExec := dbExec(tx, `DELETE FROM task WHERE agent=? AND approved=0`, dbAgentId)
+			if errExec != nil {
+				return errExec
+			}
+		} else {
+			return nil
+		}
 
-						if len(rows) > 0 {
-							packageId = rows[0][0].(int64)
-							insertedPackages[task.PackageName] = packageId
-						} else {
-							result, errExec := dbExec(tx, `INSERT INTO package(name) VALUES (?)`, task.PackageName)
-							if errExec != nil {
-								return errExec
-							}
-
-							id, errLII := result.LastInsertId()
-							if errLII != nil {
-								return errLII
-							}
-
-							packageId = id
-							insertedPackages[task.PackageName] = packageId
-						}
-					}
+		_, errExec := dbExec(tx, `UPDATE agent SET fingerprint=? WHERE id=?`, fingerprint, dbAgentId)
+		return errExec
+	})
 
-					var fromVersion interface{} = nil
-					if task.FromVersion != "" {
-						fromVersion = task.FromVersion
-					}
+	if err == nil && held {
+		atomicHeldSets.inc()
 
-					var toVersion interface{} = nil
-					if task.ToVersion != "" {
-						toVersion = task.ToVersion
-					}
+		blocking := len(tasks) - len(approvedTasks)
 
-					_, errExec := dbExec(
-						tx,
-						`
-INSERT INTO task(agent, package, from_version, to_version, action, approved)
-VALUES (?, ?, ?, ?, ?, 0)
-`,
-						dbAgentId,
-						packageId,
-						fromVersion,
-						toVersion,
-						pkgMgrAction2db[task.Action],
-					)
-					if errExec != nil {
-						return errExec
-					}
+		log.WithFields(log.Fields{
+			"agent": agent, "approved": len(approvedTasks), "blocking": blocking,
+		}).Info("Holding back approved tasks until all tasks are approved")
+
+		for task := range approvedTasks {
+			statuses[task] = &taskStatus{
+				taskHeld, fmt.Sprintf("%s, but held back until %d other task(s) are approved", statuses[task].Reason, blocking),
+			}
+		}
+	}
+
+	return
+}
+
+// dbMarkBlocking flags exactly those of agent's pending tasks as blocking which are in blocking.
+func dbMarkBlocking(tx *sql.Tx, agent int64, blocking map[common.PkgMgrTask]struct{}) error {
+	rows, errQuery := dbQuery(
+		tx,
+		`
+SELECT p.name, t.from_version, t.to_version, t.action, t.blocking
+FROM task t
+LEFT JOIN package p ON p.id=t.package
+WHERE t.agent=? AND t.approved=0`,
+		agent,
+	)
+	if errQuery != nil {
+		return errQuery
+	}
+
+	changes := map[bool]map[common.PkgMgrTask]struct{}{}
+
+	for _, row := range rows {
+		task := dbRow2Task(row)
+
+		_, isBlocking := blocking[task]
+		if isBlocking != (dbInt(row[4]) != 0) {
+			if changes[isBlocking] == nil {
+				changes[isBlocking] = map[common.PkgMgrTask]struct{}{}
+			}
+
+			changes[isBlocking][task] = struct{}{}
+		}
+	}
+
+	for isBlocking, tasks := range changes {
+		filter, values := dbTasksFilter(tasks)
+
+		_, errExec := dbExec(
+			tx,
+			`UPDATE task t SET t.blocking=? WHERE t.agent=? AND t.approved=0 AND `+filter,
+			append([]interface{}{isBlocking, agent}, values...)...,
+		)
+		if errExec != nil {
+			return errExec
+		}
+	}
+
+	return nil
+}
+
+// dbBatchSize limits the rows per multi-row statement.
+const dbBatchSize = 500
+
+// dbPlaceholders returns n comma-separated copies of placeholder.
+func dbPlaceholders(placeholder string, n int) string {
+	return strings.TrimSuffix(strings.Repeat(placeholder+",", n), ",")
+}
+
+// dbGetPackageIds returns the IDs of the packages named names, creating missing ones.
+func dbGetPackageIds(tx *sql.Tx, names map[string]struct{}) (map[string]int64, error) {
+	ids := make(map[string]int64, len(names))
+	missing := make([]string, 0, len(names))
+
+	for name := range names {
+		missing = append(missing, name)
+	}
+
+	// Concurrent transactions shall lock the same packages in the same order not to deadlock.
+	sort.Strings(missing)
+
+	// Select existing packages first not to lock them all exclusively.
+	for _, insert := range []bool{false, true} {
+		for i := 0; i < len(missing); i += dbBatchSize {
+			chunk := missing[i:]
+			if len(chunk) > dbBatchSize {
+				chunk = chunk[:dbBatchSize]
+			}
+
+			values := make([]interface{}, len(chunk))
+			for j, name := range chunk {
+				values[j] = name
+			}
+
+			if insert {
+				_, errExec := dbExec(
+					tx,
+					`INSERT INTO package(name) VALUES `+dbPlaceholders("(?)", len(chunk))+` ON DUPLICATE KEY UPDATE name=name`,
+					values...,
+				)
+				if errExec != nil {
+					return nil, errExec
 				}
 			}
-		} else if dbHasAgent {
-			_, errExec := dbExec(tx, `DELETE FROM task WHERE agent=? AND approved=0`, dbAgentId)
+
+			// The names are compared by the column's collation (e.g. case-insensitively),
+			// so select the requested ones, not the stored ones.
+			rows, errQuery := dbQuery(
+				tx,
+				`SELECT r.name, p.id FROM (SELECT ? AS name`+strings.Repeat(` UNION ALL SELECT ?`, len(chunk)-1)+
+					`) r INNER JOIN package p ON p.name=r.name`,
+				values...,
+			)
+			if errQuery != nil {
+				return nil, errQuery
+			}
+
+			for _, row := range rows {
+				ids[string(row[0].([]byte))] = dbInt(row[1])
+			}
+		}
+
+		missing = missing[:0]
+
+		for name := range names {
+			if _, exists := ids[name]; !exists {
+				missing = append(missing, name)
+			}
+		}
+
+		sort.Strings(missing)
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("couldn't resolve package %q", missing[0])
+	}
+
+	return ids, nil
+}
+
+// dbInsertPendingTasks records tasks as pending ones of agent.
+func dbInsertPendingTasks(tx *sql.Tx, agent int64, tasks map[common.PkgMgrTask]struct{}, now int64) error {
+	packageNames := map[string]struct{}{}
+	for task := range tasks {
+		packageNames[task.PackageName] = struct{}{}
+	}
+
+	packageIds, errGPI := dbGetPackageIds(tx, packageNames)
+	if errGPI != nil {
+		return errGPI
+	}
+
+	values := make([]interface{}, 0, 7*len(tasks))
+
+	for task := range tasks {
+		values = append(
+			values,
+			agent, packageIds[task.PackageName], dbNullString(task.FromVersion), dbNullString(task.ToVersion),
+			pkgMgrAction2db[task.Action], 0, now,
+		)
+	}
+
+	for i := 0; i < len(values); i += 7 * dbBatchSize {
+		chunk := values[i:]
+		if len(chunk) > 7*dbBatchSize {
+			chunk = chunk[:7*dbBatchSize]
+		}
+
+		_, errExec := dbExec(
+			tx,
+			`INSERT INTO task(agent, package, from_version, to_version, action, approved, ctime) VALUES `+
+				dbPlaceholders("(?, ?, ?, ?, ?, ?, ?)", len(chunk)/7),
+			chunk...,
+		)
+		if errExec != nil {
 			return errExec
 		}
+	}
 
-		return nil
-	})
+	return nil
+}
 
-	return
+var pendingTasksWrites = metricsRegisterCounter(
+	"pending_tasks_writes_total", "Agent polls which changed the agent's pending tasks in the database",
+)
+
+var pendingTasksUnchanged = metricsRegisterCounter(
+	"pending_tasks_unchanged_total", "Agent polls which didn't need to change anything in the database",
+)
+
+// pendingTasksFingerprint identifies what dbUpdatePendingTasks writes to the database for an agent.
+func pendingTasksFingerprint(approvedTasks, pendingTasks map[common.PkgMgrTask]struct{}, held bool) string {
+	lines := make([]string, 0, len(approvedTasks)+len(pendingTasks))
+
+	for status, tasks := range map[string]map[common.PkgMgrTask]struct{}{"a": approvedTasks, "p": pendingTasks} {
+		for task := range tasks {
+			lines = append(lines, strings.Join(
+				[]string{status, task.PackageName, task.FromVersion, task.ToVersion, pkgMgrAction2db[task.Action]}, "\x00",
+			))
+		}
+	}
+
+	sort.Strings(lines)
+
+	if held {
+		lines = append(lines, "held")
+	}
+
+	hash := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(hash[:])
 }
 
 var db2pkgMgrAction = map[string]common.PkgMgrAction{
@@ -324,209 +728,236 @@ func dbGetTasks(tx *sql.Tx, agent interface{}, approved uint8) (tasks map[common
 	tasks = map[common.PkgMgrTask]struct{}{}
 
 	for _, row := range rows {
-		nextTask := common.PkgMgrTask{
-			PackageName: "",
-			FromVersion: "",
-			ToVersion:   "",
-			Action:      255,
-		}
+		tasks[dbRow2Task(row)] = struct{}{}
+	}
 
-		if row[0] != nil {
-			nextTask.PackageName = string(row[0].([]byte))
-		}
+	return
+}
 
-		if row[1] != nil {
-			nextTask.FromVersion = string(row[1].([]byte))
-		}
+// dbRow2Task converts the columns package name, from_version, to_version and action to a task.
+// NULLs become wildcards.
+func dbRow2Task(row []interface{}) common.PkgMgrTask {
+	task := common.PkgMgrTask{
+		PackageName: "",
+		FromVersion: "",
+		ToVersion:   "",
+		Action:      255,
+	}
 
-		if row[2] != nil {
-			nextTask.ToVersion = string(row[2].([]byte))
-		}
+	if row[0] != nil {
+		task.PackageName = string(row[0].([]byte))
+	}
 
-		if row[3] != nil {
-			nextTask.Action = db2pkgMgrAction[string(row[3].([]byte))]
-		}
+	if row[1] != nil {
+		task.FromVersion = string(row[1].([]byte))
+	}
 
-		tasks[nextTask] = struct{}{}
+	if row[2] != nil {
+		task.ToVersion = string(row[2].([]byte))
 	}
 
-	return
+	if row[3] != nil {
+		task.Action = db2pkgMgrAction[string(row[3].([]byte))]
+	}
+
+	return task
 }
 
 func dbDeleteTasks(tx *sql.Tx, agent interface{}, approved uint8, tasks map[common.PkgMgrTask]struct{}) error {
 	if len(tasks) > 0 {
-		filterBase := map[string]map[common.PkgMgrAction]map[string]map[string]struct{}{}
+		filter, values := dbTasksFilter(tasks)
 
-		for task := range tasks {
-			if _, exists := filterBase[task.PackageName]; !exists {
-				filterBase[task.PackageName] = map[common.PkgMgrAction]map[string]map[string]struct{}{}
-			}
+		_, errExec := dbExec(
+			tx,
+			`DELETE t FROM task t WHERE t.agent=? AND t.approved=? AND `+filter,
+			append([]interface{}{agent, approved}, values...)...,
+		)
+		return errExec
+	}
 
-			filterPackage := filterBase[task.PackageName]
-			if _, exists := filterPackage[task.Action]; !exists {
-				filterPackage[task.Action] = map[string]map[string]struct{}{}
-			}
+	return nil
+}
 
-			filterAction := filterPackage[task.Action]
-			if _, exists := filterAction[task.FromVersion]; !exists {
-				filterAction[task.FromVersion] = map[string]struct{}{}
-			}
+// dbTasksFilter returns an SQL condition matching the rows of task t which are one of tasks and its values.
+func dbTasksFilter(tasks map[common.PkgMgrTask]struct{}) (string, []interface{}) {
+	filterBase := map[string]map[common.PkgMgrAction]map[string]map[string]struct{}{}
 
-			filterAction[task.FromVersion][task.ToVersion] = struct{}{}
+	for task := range tasks {
+		if _, exists := filterBase[task.PackageName]; !exists {
+			filterBase[task.PackageName] = map[common.PkgMgrAction]map[string]map[string]struct{}{}
 		}
 
-		type subFilter struct {
-			filter string
-			values []interface{}
+		filterPackage := filterBase[task.PackageName]
+		if _, exists := filterPackage[task.Action]; !exists {
+			filterPackage[task.Action] = map[string]map[string]struct{}{}
 		}
 
-		subFilters0 := make(map[string]subFilter, len(filterBase))
-		valuesLen0 := 2
-
-		for packageName, actions := range filterBase {
-			subFilters1 := make(map[common.PkgMgrAction]subFilter, len(actions))
-			valuesLen1 := 0
-
-			for action, fromVersions := range actions {
-				subFilters2 := make(map[string]subFilter, len(fromVersions))
-				valuesLen2 := 0
-
-				for fromVersion, toVersions := range fromVersions {
-					_, toVersionHasNull := toVersions[""]
-					if toVersionHasNull {
-						delete(toVersions, "")
-					}
-
-					if toVersionHasNull && len(toVersions) < 1 {
-						subFilters2[fromVersion] = subFilter{
-							filter: "(t.to_version IS NULL)",
-							values: []interface{}{},
-						}
-
-						valuesLen2++
-					} else {
-						filters3 := make([]string, len(toVersions))
-						values3 := make([]interface{}, len(toVersions))
-						filterIdx3 := 0
+		filterAction := filterPackage[task.Action]
+		if _, exists := filterAction[task.FromVersion]; !exists {
+			filterAction[task.FromVersion] = map[string]struct{}{}
+		}
 
-						for toVersion := range toVersions {
-							filters3[filterIdx3] = "?"
-							values3[filterIdx3] = toVersion
-							filterIdx3++
-						}
+		filterAction[task.FromVersion][task.ToVersion] = struct{}{}
+	}
 
-						filter3 := "(t.to_version IN (" + strings.Join(filters3, ",") + "))"
+	type subFilter struct {
+		filter string
+		values []interface{}
+	}
 
-						if toVersionHasNull {
-							filter3 = "(CASE WHEN (t.to_version IS NULL) THEN 1 ELSE " + filter3 + " END)"
-						}
+	subFilters0 := make(map[string]subFilter, len(filterBase))
+	valuesLen0 := 0
 
-						subFilters2[fromVersion] = subFilter{
-							filter: filter3,
-							values: values3,
-						}
+	for packageName, actions := range filterBase {
+		subFilters1 := make(map[common.PkgMgrAction]subFilter, len(actions))
+		valuesLen1 := 0
 
-						valuesLen2 += 1 + len(values3)
-					}
-				}
+		for action, fromVersions := range actions {
+			subFilters2 := make(map[string]subFilter, len(fromVersions))
+			valuesLen2 := 0
 
-				fromVersionNullFilter, fromVersionHasNull := subFilters2[""]
-				if fromVersionHasNull {
-					delete(subFilters2, "")
-					valuesLen2--
+			for fromVersion, toVersions := range fromVersions {
+				_, toVersionHasNull := toVersions[""]
+				if toVersionHasNull {
+					delete(toVersions, "")
 				}
 
-				valuesLen1 += 1 + valuesLen2
-
-				var filter2 string
-				var values2 []interface{}
+				if toVersionHasNull && len(toVersions) < 1 {
+					subFilters2[fromVersion] = subFilter{
+						filter: "(t.to_version IS NULL)",
+						values: []interface{}{},
+					}
 
-				if fromVersionHasNull && len(subFilters2) < 1 {
-					filter2 = "0"
-					values2 = fromVersionNullFilter.values
+					valuesLen2++
 				} else {
-					filters2 := make([]string, len(subFilters2))
-					filterIdx2 := 0
-					values2 = make([]interface{}, valuesLen2)
-					valueIdx2 := 0
-
-					if fromVersionHasNull {
-						copy(values2[valueIdx2:], fromVersionNullFilter.values)
-						valueIdx2 += len(fromVersionNullFilter.values)
+					filters3 := make([]string, len(toVersions))
+					values3 := make([]interface{}, len(toVersions))
+					filterIdx3 := 0
+
+					for toVersion := range toVersions {
+						filters3[filterIdx3] = "?"
+						values3[filterIdx3] = toVersion
+						filterIdx3++
 					}
 
-					for fromVersion, filter := range subFilters2 {
-						filters2[filterIdx2] = "WHEN ? THEN " + filter.filter
-						filterIdx2++
+					filter3 := "(t.to_version IN (" + strings.Join(filters3, ",") + "))"
 
-						values2[valueIdx2] = fromVersion
-						valueIdx2++
+					if toVersionHasNull {
+						filter3 = "(CASE WHEN (t.to_version IS NULL) THEN 1 ELSE " + filter3 + " END)"
+					}
 
-						copy(values2[valueIdx2:], filter.values)
-						valueIdx2 += len(filter.values)
+					subFilters2[fromVersion] = subFilter{
+						filter: filter3,
+						values: values3,
 					}
 
-					filter2 = "(CASE t.from_version " + strings.Join(filters2, " ") + " ELSE 0 END)"
+					valuesLen2 += 1 + len(values3)
 				}
+			}
+
+			fromVersionNullFilter, fromVersionHasNull := subFilters2[""]
+			if fromVersionHasNull {
+				delete(subFilters2, "")
+				valuesLen2--
+			}
+
+			valuesLen1 += 1 + valuesLen2
+
+			var filter2 string
+			var values2 []interface{}
+
+			if fromVersionHasNull && len(subFilters2) < 1 {
+				filter2 = "0"
+				values2 = fromVersionNullFilter.values
+			} else {
+				filters2 := make([]string, len(subFilters2))
+				filterIdx2 := 0
+				values2 = make([]interface{}, valuesLen2)
+				valueIdx2 := 0
 
 				if fromVersionHasNull {
-					filter2 = "(CASE WHEN (t.from_version IS NULL) THEN " + fromVersionNullFilter.filter + " ELSE " + filter2 + " END)"
+					copy(values2[valueIdx2:], fromVersionNullFilter.values)
+					valueIdx2 += len(fromVersionNullFilter.values)
 				}
 
-				subFilters1[action] = subFilter{
-					filter: filter2,
-					values: values2,
-				}
-			}
+				for fromVersion, filter := range subFilters2 {
+					filters2[filterIdx2] = "WHEN ? THEN " + filter.filter
+					filterIdx2++
 
-			valuesLen0 += 1 + valuesLen1
+					values2[valueIdx2] = fromVersion
+					valueIdx2++
 
-			filters1 := make([]string, len(subFilters1))
-			filterIdx1 := 0
-			values1 := make([]interface{}, valuesLen1)
-			valueIdx1 := 0
+					copy(values2[valueIdx2:], filter.values)
+					valueIdx2 += len(filter.values)
+				}
 
-			for action, filter := range subFilters1 {
-				filters1[filterIdx1] = "WHEN ? THEN " + filter.filter
-				filterIdx1++
-				values1[valueIdx1] = pkgMgrAction2db[action]
-				valueIdx1++
+				filter2 = "(CASE t.from_version " + strings.Join(filters2, " ") + " ELSE 0 END)"
+			}
 
-				copy(values1[valueIdx1:], filter.values)
-				valueIdx1 += len(filter.values)
+			if fromVersionHasNull {
+				filter2 = "(CASE WHEN (t.from_version IS NULL) THEN " + fromVersionNullFilter.filter + " ELSE " + filter2 + " END)"
 			}
 
-			subFilters0[packageName] = subFilter{
-				filter: "(CASE t.action " + strings.Join(filters1, " ") + " ELSE 0 END)",
-				values: values1,
+			subFilters1[action] = subFilter{
+				filter: filter2,
+				values: values2,
 			}
 		}
 
-		filters0 := make([]string, len(subFilters0))
-		filterIdx0 := 0
-		values0 := make([]interface{}, valuesLen0)
-		valueIdx0 := 2
+		valuesLen0 += 1 + valuesLen1
 
-		values0[0] = agent
-		values0[1] = approved
+		filters1 := make([]string, len(subFilters1))
+		filterIdx1 := 0
+		values1 := make([]interface{}, valuesLen1)
+		valueIdx1 := 0
 
-		for packageName, filter := range subFilters0 {
-			filters0[filterIdx0] = "WHEN (SELECT p.id FROM package p WHERE p.name=?) THEN " + filter.filter
-			filterIdx0++
-			values0[valueIdx0] = packageName
-			valueIdx0++
+		for action, filter := range subFilters1 {
+			filters1[filterIdx1] = "WHEN ? THEN " + filter.filter
+			filterIdx1++
+			values1[valueIdx1] = pkgMgrAction2db[action]
+			valueIdx1++
 
-			copy(values0[valueIdx0:], filter.values)
-			valueIdx0 += len(filter.values)
+			copy(values1[valueIdx1:], filter.values)
+			valueIdx1 += len(filter.values)
 		}
 
-		_, errExec := dbExec(
-			tx,
-			`DELETE t FROM task t WHERE t.agent=? AND t.approved=? AND (CASE t.package `+strings.Join(filters0, " ")+` ELSE 0 END)`,
-			values0...,
-		)
-		return errExec
+		subFilters0[packageName] = subFilter{
+			filter: "(CASE t.action " + strings.Join(filters1, " ") + " ELSE 0 END)",
+			values: values1,
+		}
 	}
 
-	return nil
+	filters0 := make([]string, len(subFilters0))
+	filterIdx0 := 0
+	values0 := make([]interface{}, valuesLen0)
+	valueIdx0 := 0
+
+	for packageName, filter := range subFilters0 {
+		filters0[filterIdx0] = "WHEN (SELECT p.id FROM package p WHERE p.name=?) THEN " + filter.filter
+		filterIdx0++
+		values0[valueIdx0] = packageName
+		valueIdx0++
+
+		copy(values0[valueIdx0:], filter.values)
+		valueIdx0 += len(filter.values)
+	}
+
+	return "(CASE t.package " + strings.Join(filters0, " ") + " ELSE 0 END)", values0
+}
+
+func dbNullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+
+	return s
+}
+
+func dbNullableString(value interface{}) *string {
+	if value == nil {
+		return nil
+	}
+
+	s := string(value.([]byte))
+	return &s
 }
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/masif-upgrader/common"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDbDsnEnv names the environment variable with the DSN of a scratch MySQL database.
+// Tests needing a database are skipped unless it's set. They drop all tables in that database!
+const testDbDsnEnv = "MASIF_UPGRADER_MASTER_TEST_DSN"
+
+// testDb connects to the scratch database and resets it to an empty schema.
+func testDb(t testing.TB) {
+	t.Helper()
+
+	dsn := os.Getenv(testDbDsnEnv)
+	if dsn == "" {
+		t.Skip(testDbDsnEnv + " not set")
+	}
+
+	if db == nil {
+		var errOpen error
+		if db, errOpen = sql.Open("mysql", dsn); errOpen != nil {
+			t.Fatal(errOpen)
+		}
+	}
+
+	ctx := context.Background()
+
+	conn, errCn := db.Conn(ctx)
+	if errCn != nil {
+		t.Fatal(errCn)
+	}
+
+	defer conn.Close()
+
+	rows, errQuery := conn.QueryContext(ctx, `SELECT table_name FROM information_schema.tables WHERE table_schema=DATABASE()`)
+	if errQuery != nil {
+		t.Fatal(errQuery)
+	}
+
+	var tables []string
+
+	for rows.Next() {
+		var table string
+		if errScan := rows.Scan(&table); errScan != nil {
+			t.Fatal(errScan)
+		}
+
+		tables = append(tables, table)
+	}
+
+	if errRows := rows.Err(); errRows != nil {
+		t.Fatal(errRows)
+	}
+
+	rows.Close()
+
+	if _, errExec := conn.ExecContext(ctx, `SET FOREIGN_KEY_CHECKS=0`); errExec != nil {
+		t.Fatal(errExec)
+	}
+
+	for _, table := range tables {
+		if _, errExec := conn.ExecContext(ctx, "DROP TABLE `"+table+"`"); errExec != nil {
+			t.Fatal(errExec)
+		}
+	}
+
+	if _, errExec := conn.ExecContext(ctx, `SET FOREIGN_KEY_CHECKS=1`); errExec != nil {
+		t.Fatal(errExec)
+	}
+
+	if errLS := dbLoadSchema(time.Minute); errLS != nil {
+		t.Fatal(errLS)
+	}
+
+	// The new schema's approval versions start over.
+	approvals = &approvalIndex{version: -1}
+}
+
+// testDbCount returns the result of a COUNT(*) query.
+func testDbCount(t testing.TB, query string, args ...interface{}) int64 {
+	t.Helper()
+
+	var count int64
+	if errQR := db.QueryRow(query, args...).Scan(&count); errQR != nil {
+		t.Fatal(errQR)
+	}
+
+	return count
+}
+
+// testTasks returns n distinct update tasks of as many packages named after prefix.
+func testTasks(prefix string, n int) map[common.PkgMgrTask]struct{} {
+	tasks := make(map[common.PkgMgrTask]struct{}, n)
+
+	for i := 0; i < n; i++ {
+		tasks[common.PkgMgrTask{
+			PackageName: fmt.Sprintf("%s%d", prefix, i),
+			FromVersion: "1.0",
+			ToVersion:   "1.1",
+			Action:      common.PkgMgrUpdate,
+		}] = struct{}{}
+	}
+
+	return tasks
+}
+
+// testCopyTasks copies tasks into a new map in random order.
+func testCopyTasks(tasks map[common.PkgMgrTask]struct{}) map[common.PkgMgrTask]struct{} {
+	list := make([]common.PkgMgrTask, 0, len(tasks))
+	for task := range tasks {
+		list = append(list, task)
+	}
+
+	rand.Shuffle(len(list), func(i, j int) {
+		list[i], list[j] = list[j], list[i]
+	})
+
+	copied := make(map[common.PkgMgrTask]struct{}, len(list))
+	for _, task := range list {
+		copied[task] = struct{}{}
+	}
+
+	return copied
+}
+
+func TestPendingTasksFingerprint(t *testing.T) {
+	approved := testTasks("approved", 50)
+	pending := testTasks("pending", 50)
+	fingerprint := pendingTasksFingerprint(approved, pending, false)
+
+	for i := 0; i < 20; i++ {
+		if got := pendingTasksFingerprint(testCopyTasks(approved), testCopyTasks(pending), false); got != fingerprint {
+			t.Fatal("fingerprint depends on map order")
+		}
+	}
+
+	if pendingTasksFingerprint(approved, pending, true) == fingerprint {
+		t.Error("fingerprint ignores held")
+	}
+
+	// One task approved in the meantime
+	var moved common.PkgMgrTask
+	for moved = range pending {
+		break
+	}
+
+	approvedMore := testCopyTasks(approved)
+	approvedMore[moved] = struct{}{}
+	pendingLess := testCopyTasks(pending)
+	delete(pendingLess, moved)
+
+	if pendingTasksFingerprint(approvedMore, pendingLess, false) == fingerprint {
+		t.Error("fingerprint ignores approval state")
+	}
+
+	// Same task, other version
+	pendingOther := testCopyTasks(pendingLess)
+	other := moved
+	other.ToVersion = "1.2"
+	pendingOther[other] = struct{}{}
+
+	if pendingTasksFingerprint(approved, pendingOther, false) == fingerprint {
+		t.Error("fingerprint ignores versions")
+	}
+
+	// Same task, other action
+	pendingOther = testCopyTasks(pendingLess)
+	other = moved
+	other.Action = common.PkgMgrInstall
+	pendingOther[other] = struct{}{}
+
+	if pendingTasksFingerprint(approved, pendingOther, false) == fingerprint {
+		t.Error("fingerprint ignores actions")
+	}
+
+	if pendingTasksFingerprint(nil, nil, false) == pendingTasksFingerprint(nil, nil, true) {
+		t.Error("fingerprint of empty sets ignores held")
+	}
+}
+
+func BenchmarkPendingTasksFingerprint(b *testing.B) {
+	approved := testTasks("approved", 150)
+	pending := testTasks("pending", 150)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pendingTasksFingerprint(approved, pending, false)
+	}
+}
+
+// BenchmarkUpdatePendingTasks measures polls of agents reporting the same tasks every time (no writes needed)
+// vs. different ones every time and reports the write transactions per poll.
+func BenchmarkUpdatePendingTasks(b *testing.B) {
+	testDb(b)
+
+	sets := []map[common.PkgMgrTask]struct{}{testTasks("a", 100), testTasks("b", 100)}
+
+	for _, bench := range []struct {
+		name string
+		set  func(i int) map[common.PkgMgrTask]struct{}
+	}{
+		{"unchanged", func(int) map[common.PkgMgrTask]struct{} { return sets[0] }},
+		{"changed", func(i int) map[common.PkgMgrTask]struct{} { return sets[i%2] }},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			agent := "bench-" + bench.name
+
+			// The first poll always writes.
+			if _, errUPT := dbUpdatePendingTasks(context.Background(), agent, bench.set(1)); errUPT != nil {
+				b.Fatal(errUPT)
+			}
+
+			writes := pendingTasksWrites.get()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, errUPT := dbUpdatePendingTasks(context.Background(), agent, bench.set(i)); errUPT != nil {
+					b.Fatal(errUPT)
+				}
+			}
+
+			// b.ReportMetric() needs Go 1.13.
+			b.Logf("%v writes/op", (pendingTasksWrites.get()-writes)/float64(b.N))
+		})
+	}
+}
+
+func TestDbGetPackageIds(t *testing.T) {
+	testDb(t)
+
+	var fooId int64
+
+	errTx := dbTx(context.Background(), "", func(tx *sql.Tx) error {
+		ids, errGPI := dbGetPackageIds(tx, map[string]struct{}{"Foo": {}})
+		fooId = ids["Foo"]
+		return errGPI
+	})
+	if errTx != nil {
+		t.Fatal(errTx)
+	}
+
+	names := map[string]struct{}{"foo": {}, "FOO": {}, "Foo": {}, "bar": {}}
+	var ids map[string]int64
+
+	errTx = dbTx(context.Background(), "", func(tx *sql.Tx) (err error) {
+		ids, err = dbGetPackageIds(tx, names)
+		return
+	})
+	if errTx != nil {
+		t.Fatal(errTx)
+	}
+
+	for name := range names {
+		if ids[name] == 0 {
+			t.Errorf("%s: not resolved", name)
+		}
+	}
+
+	// The default collation is case-insensitive.
+	for _, name := range []string{"foo", "FOO"} {
+		if ids[name] != fooId {
+			t.Errorf("%s: got ID %d, want the one of Foo (%d)", name, ids[name], fooId)
+		}
+	}
+
+	if packages := testDbCount(t, `SELECT COUNT(*) FROM package`); packages != 2 {
+		t.Errorf("%d packages, want 2", packages)
+	}
+}
+
+func TestDbGetPackageIdsConcurrently(t *testing.T) {
+	testDb(t)
+
+	all := make([]string, 0, 2*dbBatchSize)
+	for i := 0; i < cap(all); i++ {
+		all = append(all, fmt.Sprintf("pkg%04d", i))
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+
+	for i := range errs {
+		// Overlapping, but different sets
+		names := map[string]struct{}{}
+		for j := i; j < len(all); j += 1 + i%3 {
+			names[all[j]] = struct{}{}
+		}
+
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			errs[i] = dbTxWith(context.Background(), sql.LevelReadCommitted, "", func(tx *sql.Tx) error {
+				ids, errGPI := dbGetPackageIds(tx, names)
+				if errGPI == nil && len(ids) != len(names) {
+					errGPI = fmt.Errorf("got %d IDs for %d packages", len(ids), len(names))
+				}
+
+				return errGPI
+			})
+		}(i)
+	}
+
+	wg.Wait()
+
+	for _, errTx := range errs {
+		if errTx != nil {
+			t.Error(errTx)
+		}
+	}
+
+	if packages := testDbCount(t, `SELECT COUNT(*) FROM package`); packages != int64(len(all)) {
+		t.Errorf("%d packages, want %d", packages, len(all))
+	}
+}
+
+// testInsertPendingTasksOneByOne is how pending tasks used to be inserted, for comparison.
+func testInsertPendingTasksOneByOne(tx *sql.Tx, agent int64, tasks map[common.PkgMgrTask]struct{}, now int64) error {
+	packageIds := map[string]int64{}
+
+	for task := range tasks {
+		packageId, known := packageIds[task.PackageName]
+		if !known {
+			rows, errQuery := dbQuery(tx, `SELECT id FROM package WHERE name=?`, task.PackageName)
+			if errQuery != nil {
+				return errQuery
+			}
+
+			if len(rows) > 0 {
+				packageId = dbInt(rows[0][0])
+			} else {
+				result, errExec := dbExec(tx, `INSERT INTO package(name) VALUES (?)`, task.PackageName)
+				if errExec != nil {
+					return errExec
+				}
+
+				if packageId, errExec = result.LastInsertId(); errExec != nil {
+					return errExec
+				}
+			}
+
+			packageIds[task.PackageName] = packageId
+		}
+
+		_, errExec := dbExec(
+			tx,
+			`INSERT INTO task(agent, package, from_version, to_version, action, approved, ctime) VALUES (?, ?, ?, ?, ?, 0, ?)`,
+			agent, packageId, dbNullString(task.FromVersion), dbNullString(task.ToVersion), pkgMgrAction2db[task.Action], now,
+		)
+		if errExec != nil {
+			return errExec
+		}
+	}
+
+	return nil
+}
+
+// BenchmarkInsertPendingTasks compares inserting an agent's 300 pending tasks one by one and batched,
+// for packages already known and new ones. Every run is rolled back.
+func BenchmarkInsertPendingTasks(b *testing.B) {
+	testDb(b)
+
+	tasks := testTasks("known", 300)
+
+	errTx := dbTx(context.Background(), "", func(tx *sql.Tx) error {
+		names := map[string]struct{}{}
+		for task := range tasks {
+			names[task.PackageName] = struct{}{}
+		}
+
+		_, errGPI := dbGetPackageIds(tx, names)
+		return errGPI
+	})
+	if errTx != nil {
+		b.Fatal(errTx)
+	}
+
+	for _, packages := range []struct {
+		name  string
+		tasks map[common.PkgMgrTask]struct{}
+	}{{"known", tasks}, {"new", testTasks("new", 300)}} {
+		for _, insert := range []struct {
+			name string
+			f    func(tx *sql.Tx, agent int64, tasks map[common.PkgMgrTask]struct{}, now int64) error
+		}{{"one-by-one", testInsertPendingTasksOneByOne}, {"batched", dbInsertPendingTasks}} {
+			b.Run(packages.name+"/"+insert.name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					tx, errBT := db.Begin()
+					if errBT != nil {
+						b.Fatal(errBT)
+					}
+
+					now := time.Now().Unix()
+
+					result, errExec := dbExec(tx, `INSERT INTO agent(name, ctime, mtime) VALUES ('bench', ?, ?)`, now, now)
+					if errExec != nil {
+						b.Fatal(errExec)
+					}
+
+					agent, _ := result.LastInsertId()
+
+					if errIPT := insert.f(tx, agent, packages.tasks, now); errIPT != nil {
+						b.Fatal(errIPT)
+					}
+
+					if errRb := tx.Rollback(); errRb != nil {
+						b.Fatal(errRb)
+					}
+				}
+			})
+		}
+	}
+}
+
+// testPollConcurrently runs agent updates at isolation for many agents in parallel,
+// some of them polling for the first time at once. It returns the errors callers got
+// and how many transactions have been retried.
+func testPollConcurrently(
+	t *testing.T, agents int, isolation sql.IsolationLevel, shared, changed map[common.PkgMgrTask]struct{},
+) (errs []error, retries float64) {
+	testDb(t)
+
+	dbAgentIsolation = isolation
+	defer func() { dbAgentIsolation = sql.LevelReadCommitted }()
+
+	retries = dbTxRetries.get()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+
+	poll := func(agent string, tasks map[common.PkgMgrTask]struct{}) {
+		if _, errUPT := dbUpdatePendingTasks(context.Background(), agent, testCopyTasks(tasks)); errUPT != nil {
+			mutex.Lock()
+			errs = append(errs, fmt.Errorf("%s: %s", agent, errUPT.Error()))
+			mutex.Unlock()
+		}
+	}
+
+	for i := 0; i < agents; i++ {
+		agent := fmt.Sprintf("agent%02d", i)
+		own := testTasks(agent+"-", 10)
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			poll(agent, shared)
+			poll(agent, own)
+			poll(agent, changed)
+		}()
+
+		// Two first polls of the same agent racing on its creation
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+				poll("new-"+agent, own)
+			}()
+		}
+	}
+
+	wg.Wait()
+
+	retries = dbTxRetries.get() - retries
+	return
+}
+
+// TestUpdatePendingTasksConcurrently compares agent updates locking only the agent's row
+// with serializable ones under the same load.
+func TestUpdatePendingTasksConcurrently(t *testing.T) {
+	const agents = 16
+
+	shared := testTasks("shared", 100)
+	changed := testTasks("shared", 120)
+	for task := range testTasks("shared", 20) {
+		delete(changed, task)
+	}
+
+	serializableErrs, serializableRetries := testPollConcurrently(t, agents, sql.LevelSerializable, shared, changed)
+	errs, retries := testPollConcurrently(t, agents, sql.LevelReadCommitted, shared, changed)
+
+	t.Logf(
+		"serializable: %v retries, %d errors; read committed with row locks: %v retries, %d errors",
+		serializableRetries, len(serializableErrs), retries, len(errs),
+	)
+
+	if retries > serializableRetries {
+		t.Errorf("%v retries, more than the %v ones at serializable", retries, serializableRetries)
+	}
+
+	for _, errUPT := range errs {
+		t.Error(errUPT)
+	}
+
+	if n := testDbCount(t, `SELECT COUNT(*) FROM agent`); n != 2*agents {
+		t.Errorf("%d agents, want %d", n, 2*agents)
+	}
+
+	if n := testDbCount(t, `SELECT COUNT(DISTINCT name) FROM agent`); n != 2*agents {
+		t.Errorf("%d distinct agents, want %d", n, 2*agents)
+	}
+
+	if n := testDbCount(t, `SELECT COUNT(*) FROM task WHERE approved=0`); n != agents*int64(len(changed)+10) {
+		t.Errorf("%d pending tasks, want %d", n, agents*int64(len(changed)+10))
+	}
+
+	for i := 0; i < agents; i++ {
+		for _, agent := range []string{fmt.Sprintf("agent%02d", i), fmt.Sprintf("new-agent%02d", i)} {
+			want := int64(10)
+			if agent[0] == 'a' {
+				want = int64(len(changed))
+			}
+
+			n := testDbCount(
+				t, `SELECT COUNT(*) FROM task t INNER JOIN agent a ON a.id=t.agent WHERE a.name=? AND t.approved=0`, agent,
+			)
+			if n != want {
+				t.Errorf("%s: %d pending tasks, want %d", agent, n, want)
+			}
+		}
+	}
+}
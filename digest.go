@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/masif-upgrader/common"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/smtp"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type digestSettings struct {
+	smtp struct {
+		host, port, username, password, from string
+	}
+	to []string
+	// security matches package names and versions of security-related tasks.
+	security *regexp.Regexp
+}
+
+type digestTask struct {
+	agent string
+	task  common.PkgMgrTask
+	// ctime is zero if unknown.
+	ctime int64
+}
+
+// digestSend mails the digest of all pending tasks unless ctx is canceled before.
+func digestSend(ctx context.Context, cfg *digestSettings) error {
+	log.Info("Sending digest of pending tasks")
+
+	now := time.Now()
+	var since int64
+	var tasks []digestTask
+
+	errTx := dbReadTx(ctx, "", func(tx *sql.Tx) error {
+		rows, errQuery := dbQuery(tx, `SELECT MAX(ctime) FROM digest`)
+		if errQuery != nil {
+			return errQuery
+		}
+
+		since = dbInt(rows[0][0])
+
+		tasks, errQuery = digestGetPendingTasks(tx)
+		return errQuery
+	})
+	if errTx != nil {
+		return errTx
+	}
+
+	if len(tasks) < 1 {
+		log.Info("No pending tasks, not sending digest")
+		return nil
+	}
+
+	sent, errDl := digestDeliver(ctx, cfg, tasks, since)
+
+	// Recipients who got it shall not be told the same tasks are new again, even if ctx has been canceled since.
+	if sent > 0 {
+		errRec := dbTx(context.Background(), "", func(tx *sql.Tx) error {
+			_, errExec := dbExec(tx, `INSERT INTO digest(ctime) VALUES (?)`, now.Unix())
+			return errExec
+		})
+		if errRec != nil {
+			return errRec
+		}
+	}
+
+	return errDl
+}
+
+// digestDeliver mails the digest of tasks to all recipients and returns how many mails have been sent.
+// A failing recipient doesn't prevent the others from getting their mail, a canceled ctx does.
+func digestDeliver(ctx context.Context, cfg *digestSettings, tasks []digestTask, since int64) (sent int, err error) {
+	if errCtx := ctx.Err(); errCtx != nil {
+		return 0, errCtx
+	}
+
+	if approvalLinks == nil {
+		subject, body := digestBuild(tasks, since, cfg.security, nil)
+
+		if errSM := digestMail(cfg, cfg.to, subject, body); errSM != nil {
+			return 0, errSM
+		}
+
+		return 1, nil
+	}
+
+	var failed int
+	var lastErr error = nil
+
+	// Approval links are bound to the recipient.
+	for _, to := range cfg.to {
+		if errCtx := ctx.Err(); errCtx != nil {
+			return sent, errCtx
+		}
+
+		var errLM error = nil
+		link := func(agent string, task common.PkgMgrTask) string {
+			link, errMk := linkMake("mail:"+to, agent, task)
+			if errMk != nil {
+				errLM = errMk
+			}
+
+			return link
+		}
+
+		subject, body := digestBuild(tasks, since, cfg.security, link)
+
+		errSM := errLM
+		if errSM == nil {
+			errSM = digestMail(cfg, []string{to}, subject, body)
+		}
+
+		if errSM != nil {
+			log.WithFields(log.Fields{"to": to, "error": errSM}).Error("Couldn't send digest")
+
+			failed++
+			lastErr = errSM
+			continue
+		}
+
+		sent++
+	}
+
+	if lastErr != nil {
+		err = fmt.Errorf("couldn't send digest to %d of %d recipients: %s", failed, len(cfg.to), lastErr.Error())
+	}
+
+	return
+}
+
+func digestGetPendingTasks(tx *sql.Tx) (tasks []digestTask, err error) {
+	rows, errQuery := dbQuery(
+		tx,
+		`
+SELECT a.name, p.name, t.from_version, t.to_version, t.action, t.ctime
+FROM task t
+INNER JOIN agent a ON a.id=t.agent
+LEFT JOIN package p ON p.id=t.package
+WHERE t.approved=?
+ORDER BY a.name, p.name
+`,
+		0,
+	)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+
+	tasks = make([]digestTask, 0, len(rows))
+
+	for _, row := range rows {
+		next := digestTask{agent: string(row[0].([]byte)), task: dbRow2Task(row[1:5])}
+
+		if row[5] != nil {
+			next.ctime = dbInt(row[5])
+		}
+
+		tasks = append(tasks, next)
+	}
+
+	return
+}
+
+// digestBuild summarizes tasks per agent and fleet-wide. since is the time of the last digest.
+// link, if not nil, returns approval links for tasks of an agent or - if empty - all agents.
+func digestBuild(
+	tasks []digestTask, since int64, security *regexp.Regexp, link func(agent string, task common.PkgMgrTask) string,
+) (subject, body string) {
+	isNew := func(task digestTask) bool {
+		return task.ctime == 0 && since == 0 || task.ctime > since
+	}
+
+	isSecurity := func(task digestTask) bool {
+		return security != nil && (security.MatchString(task.task.PackageName) ||
+			security.MatchString(task.task.FromVersion) || security.MatchString(task.task.ToVersion))
+	}
+
+	tags := func(task digestTask) string {
+		var tags string
+
+		if isNew(task) {
+			tags += " [new]"
+		}
+
+		if isSecurity(task) {
+			tags += " [security]"
+		}
+
+		return tags
+	}
+
+	perAgent := map[string][]digestTask{}
+	fleet := map[common.PkgMgrTask][]digestTask{}
+	var oldest *digestTask = nil
+	var news, securities int
+
+	for i := range tasks {
+		task := &tasks[i]
+
+		perAgent[task.agent] = append(perAgent[task.agent], *task)
+		fleet[task.task] = append(fleet[task.task], *task)
+
+		if task.ctime != 0 && (oldest == nil || task.ctime < oldest.ctime) {
+			oldest = task
+		}
+
+		if isNew(*task) {
+			news++
+		}
+
+		if isSecurity(*task) {
+			securities++
+		}
+	}
+
+	buf := &bytes.Buffer{}
+
+	fmt.Fprintf(buf, "Pending tasks: %d on %d agents\n", len(tasks), len(perAgent))
+
+	if since == 0 {
+		fmt.Fprintf(buf, "New: %d\n", news)
+	} else {
+		fmt.Fprintf(buf, "New since %s: %d\n", time.Unix(since, 0).Format(time.RFC1123), news)
+	}
+
+	if security != nil {
+		fmt.Fprintf(buf, "Security-related: %d\n", securities)
+	}
+
+	if oldest != nil {
+		fmt.Fprintf(
+			buf, "Oldest outstanding: %s on %s since %s\n",
+			fmtTask(oldest.task), oldest.agent, time.Unix(oldest.ctime, 0).Format(time.RFC1123),
+		)
+	}
+
+	fleetTasks := make([]common.PkgMgrTask, 0, len(fleet))
+	for task := range fleet {
+		fleetTasks = append(fleetTasks, task)
+	}
+
+	sort.Slice(fleetTasks, func(i, j int) bool {
+		if a, b := len(fleet[fleetTasks[i]]), len(fleet[fleetTasks[j]]); a != b {
+			return a > b
+		}
+
+		return fmtTask(fleetTasks[i]) < fmtTask(fleetTasks[j])
+	})
+
+	buf.WriteString("\nFleet-wide:\n\n")
+
+	for _, task := range fleetTasks {
+		agents := fleet[task]
+		var newAgents int
+
+		for _, agentTask := range agents {
+			if isNew(agentTask) {
+				newAgents++
+			}
+		}
+
+		var securityTag string
+		if isSecurity(agents[0]) {
+			securityTag = " [security]"
+		}
+
+		fmt.Fprintf(buf, "  * %s: %d agents (%d new)%s\n", fmtTask(task), len(agents), newAgents, securityTag)
+
+		if link != nil {
+			fmt.Fprintf(buf, "    Approve for all of them: %s\n", link("", task))
+		}
+	}
+
+	agents := make([]string, 0, len(perAgent))
+	for agent := range perAgent {
+		agents = append(agents, agent)
+	}
+
+	sort.Strings(agents)
+
+	buf.WriteString("\nPer agent:\n")
+
+	for _, agent := range agents {
+		fmt.Fprintf(buf, "\n%s:\n", agent)
+
+		for _, task := range perAgent[agent] {
+			fmt.Fprintf(buf, "  * %s%s\n", fmtTask(task.task), tags(task))
+
+			if link != nil {
+				fmt.Fprintf(buf, "    Approve: %s\n", link(agent, task.task))
+			}
+		}
+	}
+
+	subject = fmt.Sprintf("Masif Upgrader: %d pending tasks on %d agents (%d new)", len(tasks), len(perAgent), news)
+	body = buf.String()
+
+	return
+}
+
+// fmtTask renders task human-readably like "nginx: update 1.24.0-1 -> 1.24.0-2".
+func fmtTask(task common.PkgMgrTask) string {
+	packageName := task.PackageName
+	if packageName == "" {
+		packageName = "*"
+	}
+
+	action, hasAction := pkgMgrAction2db[task.Action]
+	if !hasAction {
+		action = "*"
+	}
+
+	versions := []string{}
+
+	if task.FromVersion != "" {
+		versions = append(versions, task.FromVersion)
+	}
+
+	if task.ToVersion != "" {
+		versions = append(versions, task.ToVersion)
+	}
+
+	if len(versions) < 1 {
+		return packageName + ": " + action
+	}
+
+	return packageName + ": " + action + " " + strings.Join(versions, " -> ")
+}
+
+func digestMail(cfg *digestSettings, to []string, subject, body string) error {
+	log.WithFields(log.Fields{"to": to, "subject": subject}).Debug("Sending mail")
+
+	msg := &bytes.Buffer{}
+
+	fmt.Fprintf(msg, "From: %s\r\n", cfg.smtp.from)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	var auth smtp.Auth = nil
+	if cfg.smtp.username != "" {
+		auth = smtp.PlainAuth("", cfg.smtp.username, cfg.smtp.password, cfg.smtp.host)
+	}
+
+	return smtp.SendMail(net.JoinHostPort(cfg.smtp.host, cfg.smtp.port), auth, cfg.smtp.from, to, msg.Bytes())
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"github.com/masif-upgrader/common"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDigestBuild(t *testing.T) {
+	nginx := common.PkgMgrTask{PackageName: "nginx", FromVersion: "1", ToVersion: "2", Action: common.PkgMgrUpdate}
+	openssl := common.PkgMgrTask{PackageName: "openssl", FromVersion: "1.1", ToVersion: "1.2", Action: common.PkgMgrUpdate}
+	zsh := common.PkgMgrTask{PackageName: "zsh", Action: common.PkgMgrInstall}
+
+	tasks := []digestTask{
+		{"web01", nginx, 500},
+		{"web01", openssl, 800},
+		{"web02", nginx, 1500},
+		{"web02", zsh, 0},
+	}
+
+	rfc1123 := func(unix int64) string {
+		return time.Unix(unix, 0).Format(time.RFC1123)
+	}
+
+	link := func(agent string, task common.PkgMgrTask) string {
+		return "https://master.example.com/" + agent + "/" + task.PackageName
+	}
+
+	cases := []struct {
+		name     string
+		tasks    []digestTask
+		since    int64
+		security *regexp.Regexp
+		link     func(agent string, task common.PkgMgrTask) string
+		subject  string
+		// lines must appear in the body in this order.
+		lines []string
+		// absent lines must not appear in the body.
+		absent []string
+	}{
+		{
+			name: "since last digest", tasks: tasks, since: 1000, security: regexp.MustCompile(`^openssl$`),
+			subject: "Masif Upgrader: 4 pending tasks on 2 agents (1 new)",
+			lines: []string{
+				"Pending tasks: 4 on 2 agents",
+				"New since " + rfc1123(1000) + ": 1",
+				"Security-related: 1",
+				"Oldest outstanding: nginx: update 1 -> 2 on web01 since " + rfc1123(500),
+				"Fleet-wide:",
+				"  * nginx: update 1 -> 2: 2 agents (1 new)",
+				"  * openssl: update 1.1 -> 1.2: 1 agents (0 new) [security]",
+				"  * zsh: install: 1 agents (0 new)",
+				"Per agent:",
+				"web01:",
+				"  * nginx: update 1 -> 2",
+				"  * openssl: update 1.1 -> 1.2 [security]",
+				"web02:",
+				"  * nginx: update 1 -> 2 [new]",
+				"  * zsh: install",
+			},
+		},
+		{
+			name: "first digest", tasks: tasks,
+			subject: "Masif Upgrader: 4 pending tasks on 2 agents (4 new)",
+			lines: []string{
+				"New: 4",
+				"  * nginx: update 1 -> 2: 2 agents (2 new)",
+				"web01:",
+				"  * nginx: update 1 -> 2 [new]",
+				"  * openssl: update 1.1 -> 1.2 [new]",
+				"web02:",
+				"  * zsh: install [new]",
+			},
+			absent: []string{"Security-related: 0", "  * openssl: update 1.1 -> 1.2: 1 agents (1 new) [security]"},
+		},
+		{
+			name: "security by version", tasks: []digestTask{{"web01", openssl, 800}}, since: 1000,
+			security: regexp.MustCompile(`^1\.2$`),
+			subject:  "Masif Upgrader: 1 pending tasks on 1 agents (0 new)",
+			lines:    []string{"Security-related: 1", "  * openssl: update 1.1 -> 1.2 [security]"},
+		},
+		{
+			name: "unknown ages", tasks: []digestTask{{"web02", zsh, 0}}, since: 1000,
+			subject: "Masif Upgrader: 1 pending tasks on 1 agents (0 new)",
+			lines:   []string{"New since " + rfc1123(1000) + ": 0", "  * zsh: install"},
+			absent:  []string{"  * zsh: install [new]"},
+		},
+		{
+			name: "links", tasks: tasks, since: 1000, link: link,
+			subject: "Masif Upgrader: 4 pending tasks on 2 agents (1 new)",
+			lines: []string{
+				"  * nginx: update 1 -> 2: 2 agents (1 new)",
+				"    Approve for all of them: https://master.example.com//nginx",
+				"web01:",
+				"  * nginx: update 1 -> 2",
+				"    Approve: https://master.example.com/web01/nginx",
+				"  * openssl: update 1.1 -> 1.2",
+				"    Approve: https://master.example.com/web01/openssl",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		subject, body := digestBuild(c.tasks, c.since, c.security, c.link)
+
+		if subject != c.subject {
+			t.Errorf("%s: got subject %q, want %q", c.name, subject, c.subject)
+		}
+
+		bodyLines := strings.Split(body, "\n")
+		next := 0
+
+		for _, line := range c.lines {
+			for next < len(bodyLines) && bodyLines[next] != line {
+				next++
+			}
+
+			if next == len(bodyLines) {
+				t.Errorf("%s: missing line (or out of order) %q in:\n%s", c.name, line, body)
+				break
+			}
+		}
+
+		for _, line := range c.absent {
+			for _, bodyLine := range bodyLines {
+				if bodyLine == line {
+					t.Errorf("%s: unexpected line %q", c.name, line)
+				}
+			}
+		}
+
+		if c.link == nil && strings.Contains(body, "Approve") {
+			t.Errorf("%s: unexpected approval links", c.name)
+		}
+	}
+}
+
+type testMail struct {
+	from string
+	to   []string
+	data string
+}
+
+// testSmtpServer is a minimal SMTP server accepting all mail except to the rejected recipients.
+type testSmtpServer struct {
+	listener net.Listener
+	reject   map[string]struct{}
+
+	mutex sync.Mutex
+	mails []testMail
+}
+
+func newTestSmtpServer(t *testing.T, reject ...string) *testSmtpServer {
+	listener, errLs := net.Listen("tcp", "127.0.0.1:0")
+	if errLs != nil {
+		t.Fatal(errLs)
+	}
+
+	server := &testSmtpServer{listener: listener, reject: map[string]struct{}{}}
+	for _, to := range reject {
+		server.reject[to] = struct{}{}
+	}
+
+	go func() {
+		for {
+			conn, errAc := listener.Accept()
+			if errAc != nil {
+				return
+			}
+
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (s *testSmtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP")
+
+	address := func(line string) string {
+		if start, end := strings.Index(line, "<"), strings.Index(line, ">"); start >= 0 && end > start {
+			return line[start+1 : end]
+		}
+
+		return ""
+	}
+
+	var mail testMail
+
+	for {
+		line, errRL := text.ReadLine()
+		if errRL != nil {
+			return
+		}
+
+		switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250-localhost")
+			text.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			mail = testMail{from: address(line)}
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			to := address(line)
+
+			if _, rejected := s.reject[to]; rejected {
+				text.PrintfLine("550 No such user")
+			} else {
+				mail.to = append(mail.to, to)
+				text.PrintfLine("250 OK")
+			}
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+
+			data, errRDB := text.ReadDotBytes()
+			if errRDB != nil {
+				return
+			}
+
+			mail.data = string(data)
+
+			s.mutex.Lock()
+			s.mails = append(s.mails, mail)
+			s.mutex.Unlock()
+
+			text.PrintfLine("250 OK")
+		case "RSET", "NOOP":
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func (s *testSmtpServer) received() []testMail {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]testMail(nil), s.mails...)
+}
+
+func (s *testSmtpServer) settings(to ...string) *digestSettings {
+	cfg := &digestSettings{to: to}
+	cfg.smtp.host, cfg.smtp.port, _ = net.SplitHostPort(s.listener.Addr().String())
+	cfg.smtp.from = "masif-upgrader@example.com"
+
+	return cfg
+}
+
+// testDigestLinks enables approval links until the returned function is called.
+func testDigestLinks() func() {
+	approvalLinks = &linkSettings{secret: []byte("secret"), baseUrl: "https://master.example.com", ttl: time.Hour}
+
+	return func() {
+		approvalLinks = nil
+	}
+}
+
+func TestDigestDeliver(t *testing.T) {
+	tasks := []digestTask{{"web01", common.PkgMgrTask{PackageName: "nginx", Action: common.PkgMgrUpdate}, 0}}
+
+	t.Run("without links", func(t *testing.T) {
+		server := newTestSmtpServer(t)
+		defer server.listener.Close()
+
+		sent, errDl := digestDeliver(context.Background(), server.settings("a@example.com", "b@example.com"), tasks, 0)
+		if errDl != nil {
+			t.Fatal(errDl)
+		}
+
+		mails := server.received()
+		if sent != 1 || len(mails) != 1 {
+			t.Fatalf("sent %d mails, %d received, want one", sent, len(mails))
+		}
+
+		if mail := mails[0]; mail.from != "masif-upgrader@example.com" ||
+			strings.Join(mail.to, ",") != "a@example.com,b@example.com" ||
+			!strings.Contains(mail.data, "Subject: Masif Upgrader: 1 pending tasks on 1 agents (1 new)\n") ||
+			!strings.Contains(mail.data, "\n  * nginx: update [new]\n") {
+			t.Errorf("unexpected mail: %#v", mail)
+		}
+	})
+
+	t.Run("with links and a failing recipient", func(t *testing.T) {
+		defer testDigestLinks()()
+
+		server := newTestSmtpServer(t, "bounce@example.com")
+		defer server.listener.Close()
+
+		sent, errDl := digestDeliver(
+			context.Background(), server.settings("a@example.com", "bounce@example.com", "b@example.com"), tasks, 0,
+		)
+		if errDl == nil {
+			t.Error("no error for the failing recipient")
+		}
+
+		mails := server.received()
+		if sent != 2 || len(mails) != 2 {
+			t.Fatalf("sent %d mails, %d received, want two", sent, len(mails))
+		}
+
+		for i, to := range []string{"a@example.com", "b@example.com"} {
+			if strings.Join(mails[i].to, ",") != to {
+				t.Errorf("mail %d went to %v, want %s", i, mails[i].to, to)
+			}
+
+			if !strings.Contains(mails[i].data, "Approve: https://master.example.com"+linkPath) {
+				t.Errorf("mail to %s lacks approval links", to)
+			}
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		server := newTestSmtpServer(t)
+		defer server.listener.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		sent, errDl := digestDeliver(ctx, server.settings("a@example.com"), tasks, 0)
+		if errDl != context.Canceled {
+			t.Errorf("got %v, want %v", errDl, context.Canceled)
+		}
+
+		if mails := server.received(); sent != 0 || len(mails) != 0 {
+			t.Errorf("sent %d mails, %d received, want none", sent, len(mails))
+		}
+	})
+}
+
+func TestDigestSend(t *testing.T) {
+	testDb(t)
+
+	nginx := common.PkgMgrTask{PackageName: "nginx", FromVersion: "1", ToVersion: "2", Action: common.PkgMgrUpdate}
+
+	_, errUPT := dbUpdatePendingTasks(context.Background(), "web01", map[common.PkgMgrTask]struct{}{nginx: {}})
+	if errUPT != nil {
+		t.Fatal(errUPT)
+	}
+
+	defer testDigestLinks()()
+
+	server := newTestSmtpServer(t, "bounce@example.com")
+	defer server.listener.Close()
+
+	if errDS := digestSend(context.Background(), server.settings("bounce@example.com", "a@example.com")); errDS == nil {
+		t.Error("no error for the failing recipient")
+	}
+
+	if mails := server.received(); len(mails) != 1 || !strings.Contains(mails[0].data, "nginx: update 1 -> 2 [new]") {
+		t.Errorf("unexpected mails: %#v", mails)
+	}
+
+	// The recipient who got the digest mustn't be told the same tasks are new again.
+	if digests := testDbCount(t, `SELECT COUNT(*) FROM digest`); digests != 1 {
+		t.Errorf("%d digests recorded, want 1", digests)
+	}
+
+	if errDS := digestSend(context.Background(), server.settings("bounce@example.com")); errDS == nil {
+		t.Error("no error for the failing recipient")
+	}
+
+	if digests := testDbCount(t, `SELECT COUNT(*) FROM digest`); digests != 1 {
+		t.Errorf("%d digests recorded, want still 1", digests)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/masif-upgrader/common"
+	"net/http"
+	"net/url"
+)
+
+type explainMatch struct {
+	Global      bool     `json:"global"`
+	Package     *string  `json:"package"`
+	FromVersion *string  `json:"from_version"`
+	ToVersion   *string  `json:"to_version"`
+	Action      *string  `json:"action"`
+	Wildcards   []string `json:"wildcards"`
+	Approvers   int      `json:"approvers"`
+	Quorum      int      `json:"quorum"`
+	Effective   bool     `json:"effective"`
+	Reason      string   `json:"reason"`
+}
+
+// explanation tells why a task is approved for an agent or not.
+type explanation struct {
+	Approved bool `json:"approved"`
+	// Held tells whether the approved task is held back until the agent's other tasks are approved, too.
+	Held bool `json:"held"`
+	// Blocking is the number of the agent's other tasks not approved yet.
+	Blocking int            `json:"blocking"`
+	Reason   string         `json:"reason"`
+	Matches  []explainMatch `json:"matches"`
+}
+
+func explain(task common.PkgMgrTask, global, forAgent approvalRules) *explanation {
+	result := &explanation{Matches: []explainMatch{}}
+
+	for _, match := range approvalMatches(task, global, forAgent) {
+		info := explainMatch{
+			Global:    match.global,
+			Wildcards: []string{},
+			Approvers: match.approvers,
+			Quorum:    match.quorum,
+			Effective: match.effective(),
+			Reason:    match.reason(),
+		}
+
+		for _, field := range []struct {
+			name  string
+			value string
+			info  **string
+		}{
+			{"package", match.rule.PackageName, &info.Package},
+			{"from_version", match.rule.FromVersion, &info.FromVersion},
+			{"to_version", match.rule.ToVersion, &info.ToVersion},
+			{"action", pkgMgrAction2db[match.rule.Action], &info.Action},
+		} {
+			if field.value == "" {
+				info.Wildcards = append(info.Wildcards, field.name)
+			} else {
+				value := field.value
+				*field.info = &value
+			}
+		}
+
+		if info.Effective && !result.Approved {
+			result.Approved = true
+			result.Reason = info.Reason
+		}
+
+		result.Matches = append(result.Matches, info)
+	}
+
+	if !result.Approved {
+		if len(result.Matches) < 1 {
+			result.Reason = "no approval rule matches"
+		} else {
+			result.Reason = "all matching approval rules are waiting for their quorum"
+		}
+	}
+
+	return result
+}
+
+// dbExplain explains the approval status of task for agent based on the current approval rules.
+func dbExplain(tx *sql.Tx, agent string, task common.PkgMgrTask) (*explanation, error) {
+	globalApprovals, errDGA := dbGetApprovals(tx, nil)
+	if errDGA != nil {
+		return nil, errDGA
+	}
+
+	agentApprovals := approvalRules{}
+
+	agentId, errGAI := dbGetAgentId(tx, agent)
+	switch errGAI {
+	case nil:
+		if agentApprovals, errDGA = dbGetApprovals(tx, agentId); errDGA != nil {
+			return nil, errDGA
+		}
+	case approvalNoSuchAgent:
+	default:
+		return nil, errGAI
+	}
+
+	result := explain(task, globalApprovals, agentApprovals)
+
+	if result.Approved && errGAI == nil && atomicFor(agent) {
+		pendingTasks, errDGT := dbGetTasks(tx, agentId, 0)
+		if errDGT != nil {
+			return nil, errDGT
+		}
+
+		for pendingTask := range pendingTasks {
+			if pendingTask != task && !approvalCheck(pendingTask, globalApprovals, agentApprovals) {
+				result.Blocking++
+			}
+		}
+
+		if result.Blocking > 0 {
+			result.Held = true
+			result.Reason = fmt.Sprintf(
+				"%s, but held back until %d other task(s) are approved", result.Reason, result.Blocking,
+			)
+		}
+	}
+
+	return result, nil
+}
+
+// explainParseTask parses a concrete task like the agents report it from agent, package, from_version,
+// to_version and action.
+func explainParseTask(values url.Values) (agent string, task common.PkgMgrTask, err error) {
+	agent = values.Get("agent")
+	if agent == "" {
+		return "", task, errors.New("agent missing")
+	}
+
+	task = common.PkgMgrTask{
+		PackageName: values.Get("package"),
+		FromVersion: values.Get("from_version"),
+		ToVersion:   values.Get("to_version"),
+	}
+
+	if task.PackageName == "" {
+		return "", task, errors.New("package missing")
+	}
+
+	action, actionValid := db2pkgMgrAction[values.Get("action")]
+	if !actionValid {
+		return "", task, errors.New("bad action")
+	}
+
+	task.Action = action
+
+	return
+}
+
+// adminV1Explain tells why a task is approved for an agent or not.
+func adminV1Explain(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	agent, task, errEPT := explainParseTask(request.URL.Query())
+	if errEPT != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte(errEPT.Error()))
+		return
+	}
+
+	var result *explanation
+
+	if adminRespondError(writer, dbReadTx(request.Context(), adminActor(request), func(tx *sql.Tx) (err error) {
+		result, err = dbExplain(tx, agent, task)
+		return
+	})) {
+		return
+	}
+
+	adminRespond(writer, result)
+}
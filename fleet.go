@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/masif-upgrader/common"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// fleetTask is a pending task with all agents requesting it.
+type fleetTask struct {
+	Package     string   `json:"package"`
+	FromVersion *string  `json:"from_version"`
+	ToVersion   *string  `json:"to_version"`
+	Action      string   `json:"action"`
+	Count       int      `json:"count"`
+	Agents      []string `json:"agents"`
+	// Blocking are the agents whose approved tasks are held back by this one.
+	Blocking []string `json:"blocking"`
+}
+
+// dbGetFleetTasks groups identical pending tasks (of packageName if not empty) across agents.
+func dbGetFleetTasks(tx *sql.Tx, packageName string) ([]*fleetTask, error) {
+	query := `
+SELECT p.name, t.from_version, t.to_version, t.action, a.name, t.blocking
+FROM task t
+INNER JOIN agent a ON a.id=t.agent
+INNER JOIN package p ON p.id=t.package
+WHERE t.approved=0`
+
+	values := []interface{}{}
+
+	if packageName != "" {
+		query += " AND p.name=?"
+		values = append(values, packageName)
+	}
+
+	rows, errQuery := dbQuery(tx, query+" ORDER BY p.name, t.from_version, t.to_version, t.action, a.name", values...)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+
+	tasks := []*fleetTask{}
+	byTask := map[common.PkgMgrTask]*fleetTask{}
+
+	for _, row := range rows {
+		task := dbRow2Task(row)
+
+		fleet, exists := byTask[task]
+		if !exists {
+			fleet = &fleetTask{
+				Package:     task.PackageName,
+				FromVersion: dbNullableString(row[1]),
+				ToVersion:   dbNullableString(row[2]),
+				Action:      pkgMgrAction2db[task.Action],
+				Agents:      []string{},
+				Blocking:    []string{},
+			}
+
+			byTask[task] = fleet
+			tasks = append(tasks, fleet)
+		}
+
+		fleet.Count++
+		fleet.Agents = append(fleet.Agents, string(row[4].([]byte)))
+
+		if dbInt(row[5]) != 0 {
+			fleet.Blocking = append(fleet.Blocking, string(row[4].([]byte)))
+		}
+	}
+
+	return tasks, nil
+}
+
+// adminV1PendingTasks lists the pending tasks grouped across agents.
+func adminV1PendingTasks(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var tasks []*fleetTask
+
+	if errTx := dbReadTx(request.Context(), adminActor(request), func(tx *sql.Tx) (err error) {
+		tasks, err = dbGetFleetTasks(tx, request.URL.Query().Get("package"))
+		return
+	}); errTx != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	adminRespond(writer, tasks)
+}
+
+// adminV1BulkApprovals approves exactly one pending task for exactly the agents currently requesting it.
+func adminV1BulkApprovals(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	agent, task, errPR := adminReadRule(writer, request)
+	if errPR != nil {
+		return
+	}
+
+	if agent != "" || task.PackageName == "" || task.Action == 255 {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("package and action required, agent not allowed"))
+		return
+	}
+
+	var approved int64
+
+	if adminRespondError(writer, dbTx(request.Context(), adminActor(request), func(tx *sql.Tx) (err error) {
+		approved, err = dbApprovePendingTasks(tx, adminActor(request), "", task)
+		return
+	})) {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"actor": adminActor(request), "task": fmtTask(task), "approved": approved,
+	}).Info("Approved pending task for all agents requesting it")
+
+	if approved > 0 {
+		approvalHub.publish("")
+	}
+
+	adminRespond(writer, struct {
+		Approved int64 `json:"approved"`
+	}{approved})
+}
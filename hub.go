@@ -0,0 +1,76 @@
+package main
+
+import "sync"
+
+// hub notifies long-polling agents about approvals.
+type hub struct {
+	mutex sync.Mutex
+	// subscribers are by agent name.
+	subscribers map[string]map[chan struct{}]struct{}
+}
+
+var approvalHub = &hub{subscribers: map[string]map[chan struct{}]struct{}{}}
+
+var hubNotifications = metricsRegisterCounter("hub_notifications_total", "Long-polling agents notified about approvals")
+
+func init() {
+	metricsRegisterGauge("hub_subscribers", "Long-polling agents", func() float64 {
+		approvalHub.mutex.Lock()
+		defer approvalHub.mutex.Unlock()
+
+		n := 0
+		for _, subscribers := range approvalHub.subscribers {
+			n += len(subscribers)
+		}
+
+		return float64(n)
+	})
+}
+
+// subscribe returns a channel which receives a value once something has been approved for agent.
+// unsubscribe must follow.
+func (h *hub) subscribe(agent string) chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, exists := h.subscribers[agent]; !exists {
+		h.subscribers[agent] = map[chan struct{}]struct{}{}
+	}
+
+	h.subscribers[agent][ch] = struct{}{}
+	return ch
+}
+
+func (h *hub) unsubscribe(agent string, ch chan struct{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if subscribers, exists := h.subscribers[agent]; exists {
+		delete(subscribers, ch)
+
+		if len(subscribers) < 1 {
+			delete(h.subscribers, agent)
+		}
+	}
+}
+
+// publish notifies the subscribers of agent (or all if empty) that something has been approved.
+// Call it after the approval has been committed.
+func (h *hub) publish(agent string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for name, subscribers := range h.subscribers {
+		if agent == "" || name == agent {
+			for ch := range subscribers {
+				select {
+				case ch <- struct{}{}:
+					hubNotifications.inc()
+				default:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"github.com/go-ini/ini"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+type identityContextKey struct{}
+
+var identitySources = map[string]func(cert *x509.Certificate) string{
+	"cn": func(cert *x509.Certificate) string {
+		return cert.Subject.CommonName
+	},
+	"dns_san": func(cert *x509.Certificate) string {
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+
+		return ""
+	},
+	"uri_san": func(cert *x509.Certificate) string {
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+
+		return ""
+	},
+	"fingerprint": func(cert *x509.Certificate) string {
+		fingerprint := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(fingerprint[:])
+	},
+}
+
+// identityMapper derives agent names from verified client certificates.
+type identityMapper struct {
+	source  func(cert *x509.Certificate) string
+	renames map[string]string
+}
+
+func newIdentityMapper(source, mapFile string) (*identityMapper, error) {
+	mapper := &identityMapper{source: identitySources[source], renames: map[string]string{}}
+
+	if mapFile != "" {
+		log.WithFields(log.Fields{"file": mapFile}).Debug("Loading agent identity mapping")
+
+		// Only "=" separates, so that identities like URI SANs may contain ":".
+		mapping, errLI := ini.LoadSources(ini.LoadOptions{KeyValueDelimiters: "="}, mapFile)
+		if errLI != nil {
+			return nil, errLI
+		}
+
+		for _, key := range mapping.Section("").Keys() {
+			mapper.renames[key.Name()] = key.String()
+		}
+	}
+
+	return mapper, nil
+}
+
+func (m *identityMapper) identify(cert *x509.Certificate) string {
+	identity := m.source(cert)
+
+	if renamed, isRenamed := m.renames[identity]; isRenamed {
+		return renamed
+	}
+
+	return identity
+}
+
+// middleware identifies the agent behind a request before passing it on.
+func (m *identityMapper) middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var agent string
+		if chains := proxyVerifiedChains(r); len(chains) > 0 {
+			agent = m.identify(chains[0][0])
+		}
+
+		if agent == "" {
+			log.WithFields(log.Fields{"remote": r.RemoteAddr}).Warn("Couldn't identify agent by TLS cert")
+
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("no agent identity in TLS cert"))
+			return
+		}
+
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, agent)))
+	})
+}
+
+// identityAgent returns the agent identified by identityMapper.middleware.
+func identityAgent(r *http.Request) string {
+	agent, _ := r.Context().Value(identityContextKey{}).(string)
+	return agent
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdentityMapper(t *testing.T) {
+	dir, errTD := ioutil.TempDir("", "masif-upgrader-master")
+	if errTD != nil {
+		t.Fatal(errTD)
+	}
+
+	defer os.RemoveAll(dir)
+
+	mapFile := filepath.Join(dir, "map.ini")
+	errWF := ioutil.WriteFile(mapFile, []byte(`old.example.com=new.example.com
+spiffe://example.org/host/web01=web01.example.com
+`), 0600)
+	if errWF != nil {
+		t.Fatal(errWF)
+	}
+
+	spiffe, _ := url.Parse("spiffe://example.org/host/web01")
+	other, _ := url.Parse("spiffe://example.org/host/web02")
+	pki := newTestPki(t, "Identity CA")
+
+	cases := []struct {
+		source, want string
+		customize    func(template *x509.Certificate)
+	}{
+		{"cn", "new.example.com", nil},
+		{"cn", "other.example.com", func(template *x509.Certificate) {
+			template.Subject.CommonName = "other.example.com"
+		}},
+		{"dns_san", "new.example.com", func(template *x509.Certificate) {
+			template.DNSNames = []string{"old.example.com", "alias.example.com"}
+		}},
+		{"dns_san", "", nil},
+		{"uri_san", "web01.example.com", func(template *x509.Certificate) {
+			template.URIs = []*url.URL{spiffe}
+		}},
+		{"uri_san", "spiffe://example.org/host/web02", func(template *x509.Certificate) {
+			template.URIs = []*url.URL{other}
+		}},
+	}
+
+	for _, c := range cases {
+		mapper, errNIM := newIdentityMapper(c.source, mapFile)
+		if errNIM != nil {
+			t.Fatal(errNIM)
+		}
+
+		cert := pki.issue(t, "old.example.com", c.customize)
+
+		if got := mapper.identify(cert); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.source, got, c.want)
+		}
+	}
+}
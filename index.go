@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// approvalIndexPollInterval is how often the approval version is checked for changes made outside this process.
+const approvalIndexPollInterval = time.Second
+
+// approvalIndex caches all approval rules as of a particular version of the approval_version table
+// which is bumped by triggers on every approval change.
+type approvalIndex struct {
+	mutex   sync.RWMutex
+	version int64
+	global  approvalRules
+	agents  map[int64]approvalRules
+}
+
+var approvals = &approvalIndex{version: -1}
+
+var approvalIndexReloads = metricsRegisterCounter("approval_index_reloads_total", "Loads of all approval rules")
+
+func init() {
+	metricsRegisterGauge("approval_index_version", "Version of the cached approval rules", func() float64 {
+		approvals.mutex.RLock()
+		defer approvals.mutex.RUnlock()
+
+		return float64(approvals.version)
+	})
+}
+
+func dbGetApprovalVersion(tx *sql.Tx) (int64, error) {
+	rows, errQuery := dbQuery(tx, `SELECT version FROM approval_version WHERE id=1`)
+	if errQuery != nil {
+		return 0, errQuery
+	}
+
+	if len(rows) < 1 {
+		return 0, nil
+	}
+
+	return dbInt(rows[0][0]), nil
+}
+
+// get returns the global approval rules and the ones for agent (an ID or nil) as visible to tx.
+// The results must not be modified.
+func (i *approvalIndex) get(tx *sql.Tx, agent interface{}) (global, forAgent approvalRules, err error) {
+	version, errGAV := dbGetApprovalVersion(tx)
+	if errGAV != nil {
+		return nil, nil, errGAV
+	}
+
+	i.mutex.RLock()
+	current := i.version == version
+	global, agents := i.global, i.agents
+	i.mutex.RUnlock()
+
+	if !current {
+		if global, agents, err = i.load(tx, version); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	forAgent = approvalRules{}
+
+	if id, hasAgent := agent.(int64); hasAgent {
+		if rules, hasRules := agents[id]; hasRules {
+			forAgent = rules
+		}
+	}
+
+	return
+}
+
+func (i *approvalIndex) load(tx *sql.Tx, version int64) (global approvalRules, agents map[int64]approvalRules, err error) {
+	log.WithFields(log.Fields{"version": version}).Debug("Loading approval rules")
+
+	rows, errQuery := dbQuery(tx, `
+SELECT t.agent, p.name, t.from_version, t.to_version, t.action
+FROM task t
+LEFT JOIN package p ON p.id=t.package
+WHERE t.approved=1`)
+	if errQuery != nil {
+		return nil, nil, errQuery
+	}
+
+	global = approvalRules{}
+	agents = map[int64]approvalRules{}
+
+	rulesOf := func(agent interface{}) approvalRules {
+		if agent == nil {
+			return global
+		}
+
+		id := dbInt(agent)
+		if _, exists := agents[id]; !exists {
+			agents[id] = approvalRules{}
+		}
+
+		return agents[id]
+	}
+
+	for _, row := range rows {
+		rulesOf(row[0])[dbRow2Task(row[1:])] = map[string]struct{}{}
+	}
+
+	if len(quorums) > 0 && len(rows) > 0 {
+		rows, errQuery := dbQuery(tx, `
+SELECT v.agent, p.name, v.from_version, v.to_version, v.action, v.approver
+FROM approval_vote v
+LEFT JOIN package p ON p.id=v.package`)
+		if errQuery != nil {
+			return nil, nil, errQuery
+		}
+
+		for _, row := range rows {
+			if approvers, isApproved := rulesOf(row[0])[dbRow2Task(row[1:])]; isApproved {
+				approvers[string(row[5].([]byte))] = struct{}{}
+			}
+		}
+	}
+
+	approvalIndexReloads.inc()
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if version > i.version {
+		i.version = version
+		i.global = global
+		i.agents = agents
+	}
+
+	return
+}
+
+// approvalIndexWatch reloads the approval rules once changed by anyone (e.g. the UI)
+// and notifies long-polling agents.
+func approvalIndexWatch() {
+	var lastVersion int64 = -1
+
+	for {
+		var version int64
+
+		// Plain reads at READ COMMITTED don't lock anything, so writers bumping the version aren't held up.
+		// Rules loaded newer than version are just loaded again once the version is seen changed.
+		errTx := dbTxWith(context.Background(), sql.LevelReadCommitted, "", func(tx *sql.Tx) (err error) {
+			if version, err = dbGetApprovalVersion(tx); err == nil && version != lastVersion {
+				_, _, err = approvals.get(tx, nil)
+			}
+
+			return
+		})
+
+		if errTx == nil && version != lastVersion {
+			if lastVersion >= 0 {
+				approvalHub.publish("")
+			}
+
+			lastVersion = version
+		}
+
+		time.Sleep(approvalIndexPollInterval)
+	}
+}
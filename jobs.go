@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// job is periodic work run by the leader.
+type job struct {
+	name string
+	// expr is the schedule as configured.
+	expr     string
+	schedule cronSchedule
+	run      func(ctx context.Context) error
+
+	mutex   sync.Mutex
+	running bool
+	nextRun time.Time
+}
+
+// jobs are all registered jobs by name.
+var jobs = map[string]*job{}
+
+// jobDefaults are the schedules of the known jobs unless configured in the jobs section.
+var jobDefaults = map[string]string{
+	"webhooks": "@every 5s",
+	"digest":   "0 8 * * *",
+}
+
+var jobRuns = metricsRegisterCounter("job_runs_total", "Background job runs")
+var jobFailures = metricsRegisterCounter("job_failures_total", "Failed background job runs")
+var jobOverlaps = metricsRegisterCounter(
+	"job_overlaps_total", "Background job runs skipped as the previous one was still running",
+)
+
+// jobRegister adds a job to run per expr (a cron expression, see cronParse).
+func jobRegister(name, expr string, run func(ctx context.Context) error) error {
+	schedule, errCP := cronParse(expr)
+	if errCP != nil {
+		return errCP
+	}
+
+	jobs[name] = &job{name: name, expr: expr, schedule: schedule, run: run}
+	return nil
+}
+
+// jobsRun runs all registered jobs on schedule forever.
+func jobsRun() {
+	for _, j := range jobs {
+		log.WithFields(log.Fields{"job": j.name, "schedule": j.expr}).Info("Scheduling job")
+
+		go j.loop()
+	}
+}
+
+func (j *job) loop() {
+	for {
+		now := time.Now()
+		next := j.schedule.next(now)
+		if next.IsZero() {
+			log.WithFields(log.Fields{"job": j.name, "schedule": j.expr}).Error("Job will never run")
+			return
+		}
+
+		j.mutex.Lock()
+		j.nextRun = next
+		j.mutex.Unlock()
+
+		log.WithFields(log.Fields{"job": j.name, "next": next}).Debug("Scheduled next job run")
+
+		time.Sleep(next.Sub(now))
+
+		ctx := leaderContext()
+		if ctx == nil {
+			log.WithFields(log.Fields{"job": j.name}).Debug("Not running job as not the leader")
+			continue
+		}
+
+		j.mutex.Lock()
+		overlaps := j.running
+		j.running = true
+		j.mutex.Unlock()
+
+		if overlaps {
+			jobOverlaps.inc()
+			log.WithFields(log.Fields{"job": j.name}).Warn("Skipping job run as the previous one is still running")
+			continue
+		}
+
+		go j.runOnce(ctx)
+	}
+}
+
+// runOnce runs the job until done or ctx is canceled, unless another instance is still running it.
+func (j *job) runOnce(ctx context.Context) {
+	defer func() {
+		j.mutex.Lock()
+		j.running = false
+		j.mutex.Unlock()
+	}()
+
+	leader.mutex.RLock()
+	instance := leader.instance
+	leader.mutex.RUnlock()
+
+	start := time.Now()
+
+	claimed, errCJ := dbClaimJob(ctx, j.name, instance, start)
+	if errCJ != nil {
+		log.WithFields(log.Fields{"job": j.name, "error": errCJ}).Error("Couldn't claim job run")
+		return
+	}
+
+	if !claimed {
+		jobOverlaps.inc()
+		log.WithFields(log.Fields{"job": j.name}).Warn("Skipping job run as another instance is still running it")
+		return
+	}
+
+	jobRuns.inc()
+	log.WithFields(log.Fields{"job": j.name}).Info("Running job")
+
+	done := make(chan struct{})
+	go j.heartbeat(instance, done)
+
+	errRun := j.run(ctx)
+	end := time.Now()
+
+	close(done)
+
+	if errRun == nil {
+		log.WithFields(log.Fields{"job": j.name, "duration": end.Sub(start)}).Info("Job succeeded")
+	} else {
+		jobFailures.inc()
+		log.WithFields(log.Fields{"job": j.name, "duration": end.Sub(start), "error": errRun}).Error("Job failed")
+	}
+
+	if errRE := dbRecordJobEnd(j.name, instance, end, errRun); errRE != nil {
+		log.WithFields(log.Fields{"job": j.name, "error": errRE}).Error("Couldn't record job end")
+	}
+}
+
+// heartbeat tells the other instances that this one is still running the job until done is closed.
+// That's even after losing leadership, as long as the job didn't stop yet.
+func (j *job) heartbeat(instance string, done chan struct{}) {
+	ticker := time.NewTicker(leaderInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			errTx := dbTx(context.Background(), "", func(tx *sql.Tx) error {
+				_, errExec := dbExec(
+					tx,
+					`UPDATE job SET heartbeat=UNIX_TIMESTAMP() WHERE name=? AND instance=? AND status='running'`,
+					j.name,
+					instance,
+				)
+				return errExec
+			})
+			if errTx != nil {
+				log.WithFields(log.Fields{"job": j.name, "error": errTx}).Error("Couldn't update job heartbeat")
+			}
+		}
+	}
+}
+
+// dbClaimJob records instance running the job since start unless another instance is still running it.
+// A run is considered over if its heartbeat has stopped.
+func dbClaimJob(ctx context.Context, name, instance string, start time.Time) (claimed bool, err error) {
+	err = dbTx(ctx, "", func(tx *sql.Tx) error {
+		rows, errQuery := dbQuery(
+			tx,
+			`
+SELECT 1 FROM job WHERE name=? AND status='running' AND instance<>? AND heartbeat>=UNIX_TIMESTAMP()-?
+FOR UPDATE`,
+			name,
+			instance,
+			int64(3*leaderInterval/time.Second),
+		)
+		if errQuery != nil {
+			return errQuery
+		}
+
+		if claimed = len(rows) < 1; !claimed {
+			return nil
+		}
+
+		_, errExec := dbExec(
+			tx,
+			`
+INSERT INTO job(name, instance, last_start, status, heartbeat) VALUES (?, ?, ?, 'running', UNIX_TIMESTAMP())
+ON DUPLICATE KEY UPDATE instance=VALUES(instance), last_start=VALUES(last_start), status=VALUES(status),
+  heartbeat=VALUES(heartbeat)`,
+			name,
+			instance,
+			start.Unix(),
+		)
+		return errExec
+	})
+
+	return
+}
+
+func dbRecordJobEnd(name, instance string, end time.Time, errRun error) error {
+	status := "success"
+	var lastError interface{} = nil
+
+	if errRun != nil {
+		status = "failure"
+		lastError = errRun.Error()
+	}
+
+	return dbTx(context.Background(), "", func(tx *sql.Tx) error {
+		_, errExec := dbExec(
+			tx,
+			`UPDATE job SET last_end=?, status=?, last_error=? WHERE name=? AND instance=?`,
+			end.Unix(), status, lastError, name, instance,
+		)
+		return errExec
+	})
+}
+
+// jobStatus is the API representation of a job.
+type jobStatus struct {
+	Name      string  `json:"name"`
+	Schedule  string  `json:"schedule"`
+	NextRun   int64   `json:"next_run"`
+	Running   bool    `json:"running"`
+	Instance  *string `json:"instance"`
+	LastStart *int64  `json:"last_start"`
+	LastEnd   *int64  `json:"last_end"`
+	Status    *string `json:"status"`
+	LastError *string `json:"last_error"`
+}
+
+// adminV1Jobs lists the jobs with their last run.
+func adminV1Jobs(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses := make([]*jobStatus, 0, len(jobs))
+	byName := make(map[string]*jobStatus, len(jobs))
+
+	for _, j := range jobs {
+		j.mutex.Lock()
+		status := &jobStatus{Name: j.name, Schedule: j.expr, NextRun: j.nextRun.Unix(), Running: j.running}
+		j.mutex.Unlock()
+
+		statuses = append(statuses, status)
+		byName[j.name] = status
+	}
+
+	sort.Slice(statuses, func(i, k int) bool {
+		return statuses[i].Name < statuses[k].Name
+	})
+
+	errTx := dbReadTx(request.Context(), adminActor(request), func(tx *sql.Tx) error {
+		rows, errQuery := dbQuery(tx, `SELECT name, instance, last_start, last_end, status, last_error FROM job`)
+		if errQuery != nil {
+			return errQuery
+		}
+
+		for _, row := range rows {
+			if status, known := byName[string(row[0].([]byte))]; known {
+				status.Instance = dbNullableString(row[1])
+				status.LastStart = jobNullableInt(row[2])
+				status.LastEnd = jobNullableInt(row[3])
+				status.Status = dbNullableString(row[4])
+				status.LastError = dbNullableString(row[5])
+			}
+		}
+
+		return nil
+	})
+	if errTx != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	adminRespond(writer, statuses)
+}
+
+func jobNullableInt(value interface{}) *int64 {
+	if value == nil {
+		return nil
+	}
+
+	i := dbInt(value)
+	return &i
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDbClaimJob(t *testing.T) {
+	testDb(t)
+
+	claim := func(instance string) bool {
+		claimed, errCJ := dbClaimJob(context.Background(), "digest", instance, time.Now())
+		if errCJ != nil {
+			t.Fatal(errCJ)
+		}
+
+		return claimed
+	}
+
+	if !claim("master1") {
+		t.Fatal("first run not claimed")
+	}
+
+	if claim("master2") {
+		t.Error("claimed while another instance is running the job")
+	}
+
+	// The former leader has crashed.
+	if _, errExec := db.Exec(`UPDATE job SET heartbeat=heartbeat-60 WHERE name='digest'`); errExec != nil {
+		t.Fatal(errExec)
+	}
+
+	if !claim("master2") {
+		t.Fatal("not claimed after the other instance's heartbeat stopped")
+	}
+
+	// The former leader's late end mustn't end the new leader's run.
+	if errRE := dbRecordJobEnd("digest", "master1", time.Now(), nil); errRE != nil {
+		t.Fatal(errRE)
+	}
+
+	if claim("master1") {
+		t.Error("claimed while another instance is running the job")
+	}
+
+	if errRE := dbRecordJobEnd("digest", "master2", time.Now(), nil); errRE != nil {
+		t.Fatal(errRE)
+	}
+
+	if !claim("master1") {
+		t.Error("not claimed after the last run has ended")
+	}
+}
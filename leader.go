@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// leaderInterval is how often the leader checks its lock and the others try to take it over.
+const leaderInterval = 2 * time.Second
+
+// leaderLock is the name of the MySQL lock held by the leader, scoped to the database.
+// The database's name is hashed as lock names may have at most 64 characters.
+const leaderLock = `CONCAT('masif_upgrader_master_leader_', MD5(DATABASE()))`
+
+// leaderState tells which instance runs the background jobs.
+type leaderState struct {
+	mutex sync.RWMutex
+	// instance is this one's name.
+	instance string
+	leading  bool
+	// current is the leader's name as last seen, empty if unknown.
+	current string
+	// ctx is canceled once this instance ceases to be the leader.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var leader = &leaderState{}
+
+var leaderChanges = metricsRegisterCounter(
+	"leader_changes_total", "Times this instance became or ceased to be the leader",
+)
+
+func init() {
+	metricsRegisterGauge("leader", "Whether this instance is the leader running background jobs", func() float64 {
+		if leading() {
+			return 1
+		}
+
+		return 0
+	})
+}
+
+// leading tells whether this instance shall run background jobs now.
+func leading() bool {
+	leader.mutex.RLock()
+	defer leader.mutex.RUnlock()
+
+	return leader.leading
+}
+
+// leaderContext returns a context canceled once this instance ceases to be the leader, nil if not leading.
+func leaderContext() context.Context {
+	leader.mutex.RLock()
+	defer leader.mutex.RUnlock()
+
+	if !leader.leading {
+		return nil
+	}
+
+	return leader.ctx
+}
+
+func (l *leaderState) set(leading bool, current string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if leading != l.leading {
+		leaderChanges.inc()
+
+		if leading {
+			log.WithFields(log.Fields{"instance": l.instance}).Info("Became leader")
+
+			l.ctx, l.cancel = context.WithCancel(context.Background())
+		} else {
+			log.WithFields(log.Fields{"instance": l.instance}).Warn("Lost leadership")
+
+			l.cancel()
+		}
+	}
+
+	if current != l.current && !leading && current != "" {
+		log.WithFields(log.Fields{"leader": current}).Info("Following leader")
+	}
+
+	l.leading = leading
+	l.current = current
+}
+
+// leaderElect competes for leadership forever. The leader holds a MySQL lock on a dedicated connection,
+// so it's released as soon as the leader dies or loses its connection.
+func leaderElect(instance string) {
+	leader.mutex.Lock()
+	leader.instance = instance
+	leader.mutex.Unlock()
+
+	for {
+		if errLd := leaderLead(instance); errLd != nil {
+			log.WithFields(log.Fields{"error": errLd}).Error("Couldn't lead")
+		}
+
+		current, errGL := dbGetLeader()
+		if errGL != nil {
+			log.WithFields(log.Fields{"error": errGL}).Error("Couldn't look up leader")
+		}
+
+		leader.set(false, current)
+		time.Sleep(leaderInterval)
+	}
+}
+
+// leaderLead takes the leader lock if free and holds it until the connection fails.
+func leaderLead(instance string) error {
+	ctx := context.Background()
+
+	conn, errCn := db.Conn(ctx)
+	if errCn != nil {
+		return errCn
+	}
+
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	if errQR := conn.QueryRowContext(ctx, `SELECT GET_LOCK(`+leaderLock+`, 0)`).Scan(&locked); errQR != nil {
+		return errQR
+	}
+
+	if locked.Int64 != 1 {
+		return nil
+	}
+
+	defer conn.ExecContext(ctx, `DO RELEASE_LOCK(`+leaderLock+`)`)
+
+	for {
+		// The heartbeat goes through the held connection, so leading doesn't need a second one.
+		_, errExec := conn.ExecContext(
+			ctx,
+			`
+INSERT INTO leader(id, instance, since, heartbeat) VALUES (1, ?, UNIX_TIMESTAMP(), UNIX_TIMESTAMP())
+ON DUPLICATE KEY UPDATE since=IF(instance=VALUES(instance), since, VALUES(since)),
+  instance=VALUES(instance), heartbeat=VALUES(heartbeat)`,
+			instance,
+		)
+		if errExec != nil {
+			return errExec
+		}
+
+		leader.set(true, instance)
+		time.Sleep(leaderInterval)
+
+		// Still holding the lock? (The connection may have been lost in the meantime.)
+		var owned sql.NullInt64
+		errQR := conn.QueryRowContext(ctx, `SELECT IS_USED_LOCK(`+leaderLock+`)=CONNECTION_ID()`).Scan(&owned)
+		if errQR != nil {
+			return errQR
+		}
+
+		if owned.Int64 != 1 {
+			return nil
+		}
+	}
+}
+
+func dbGetLeader() (current string, err error) {
+	err = dbTx(context.Background(), "", func(tx *sql.Tx) error {
+		rows, errQuery := dbQuery(
+			tx, `SELECT instance FROM leader WHERE id=1 AND heartbeat>=UNIX_TIMESTAMP()-?`, int64(3*leaderInterval/time.Second),
+		)
+		if errQuery != nil {
+			return errQuery
+		}
+
+		if len(rows) > 0 {
+			current = string(rows[0][0].([]byte))
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// leaderHealth tells whether this instance is up and who's the leader.
+func leaderHealth(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	leader.mutex.RLock()
+	health := struct {
+		Instance string  `json:"instance"`
+		Leading  bool    `json:"leading"`
+		Leader   *string `json:"leader"`
+	}{leader.instance, leader.leading, nil}
+
+	if leader.current != "" {
+		current := leader.current
+		health.Leader = &current
+	}
+	leader.mutex.RUnlock()
+
+	adminRespond(writer, &health)
+}
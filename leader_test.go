@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestLeaderContext(t *testing.T) {
+	defer func() {
+		leader = &leaderState{}
+	}()
+
+	if leaderContext() != nil {
+		t.Error("got a context while not leading")
+	}
+
+	leader.set(true, "master1")
+
+	ctx := leaderContext()
+	if ctx == nil {
+		t.Fatal("got no context while leading")
+	}
+
+	// Still the same leadership
+	leader.set(true, "master1")
+
+	if leaderContext() != ctx || ctx.Err() != nil {
+		t.Error("context replaced or canceled while still leading")
+	}
+
+	leader.set(false, "master2")
+
+	if ctx.Err() == nil {
+		t.Error("context not canceled on losing leadership")
+	}
+
+	if leaderContext() != nil {
+		t.Error("got a context after losing leadership")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/masif-upgrader/common"
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const linkPath = "/v1/approval-links/"
+
+var linkBadToken = errors.New("bad approval link")
+var linkExpired = errors.New("approval link has expired")
+var linkUsed = errors.New("approval link has already been used")
+
+type linkSettings struct {
+	secret  []byte
+	baseUrl string
+	ttl     time.Duration
+}
+
+// approvalLinks is nil unless approval links are configured.
+var approvalLinks *linkSettings = nil
+
+// linkToken is what an approval link's token says, signed by the master.
+type linkToken struct {
+	Nonce string `json:"n"`
+	// Identity is the one the link has been issued for.
+	Identity string `json:"i"`
+	Expires  int64  `json:"e"`
+	// Agent is empty for approving the task for all agents currently requesting it.
+	Agent       string `json:"a,omitempty"`
+	PackageName string `json:"p"`
+	FromVersion string `json:"f,omitempty"`
+	ToVersion   string `json:"t,omitempty"`
+	Action      string `json:"c"`
+}
+
+func (t *linkToken) task() common.PkgMgrTask {
+	return common.PkgMgrTask{
+		PackageName: t.PackageName,
+		FromVersion: t.FromVersion,
+		ToVersion:   t.ToVersion,
+		Action:      db2pkgMgrAction[t.Action],
+	}
+}
+
+func linkSign(payload string) string {
+	mac := hmac.New(sha256.New, approvalLinks.secret)
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// linkMake returns a link approving task for agent (or all agents requesting it if empty) issued for identity.
+func linkMake(identity, agent string, task common.PkgMgrTask) (string, error) {
+	nonce := make([]byte, 16)
+	if _, errRd := io.ReadFull(rand.Reader, nonce); errRd != nil {
+		return "", errRd
+	}
+
+	jsn, errJM := json.Marshal(&linkToken{
+		Nonce:       hex.EncodeToString(nonce),
+		Identity:    identity,
+		Expires:     time.Now().Add(approvalLinks.ttl).Unix(),
+		Agent:       agent,
+		PackageName: task.PackageName,
+		FromVersion: task.FromVersion,
+		ToVersion:   task.ToVersion,
+		Action:      pkgMgrAction2db[task.Action],
+	})
+	if errJM != nil {
+		return "", errJM
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(jsn)
+
+	return strings.TrimSuffix(approvalLinks.baseUrl, "/") + linkPath + payload + "." + linkSign(payload), nil
+}
+
+func linkParse(raw string) (*linkToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(linkSign(parts[0]))) {
+		return nil, linkBadToken
+	}
+
+	jsn, errDS := base64.RawURLEncoding.DecodeString(parts[0])
+	if errDS != nil {
+		return nil, linkBadToken
+	}
+
+	token := &linkToken{}
+	if errJU := json.Unmarshal(jsn, token); errJU != nil {
+		return nil, linkBadToken
+	}
+
+	if _, actionValid := db2pkgMgrAction[token.Action]; !actionValid || token.PackageName == "" {
+		return nil, linkBadToken
+	}
+
+	if time.Now().Unix() > token.Expires {
+		return nil, linkExpired
+	}
+
+	return token, nil
+}
+
+var linkPage = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Masif Upgrader</title>
+</head>
+<body>
+{{if .Error}}<p>{{.Error}}</p>{{else if .Done}}<p>Approved {{.Approved}} task(s) as {{.Identity}}.</p>{{else}}
+<p>Approve <strong>{{.Task}}</strong> on {{if .Agent}}<strong>{{.Agent}}</strong>{{else}}all agents requesting it{{end}} as {{.Identity}}?</p>
+<form method="post"><button type="submit">Approve</button></form>
+{{end}}
+</body>
+</html>
+`))
+
+type linkPageData struct {
+	Error, Task, Agent, Identity string
+	Done                         bool
+	Approved                     int64
+}
+
+// linkHandler shows what an approval link would approve on GET and approves it on POST.
+// (Mail scanners following links must not approve anything.)
+func linkHandler(writer http.ResponseWriter, request *http.Request) {
+	token, errLP := linkParse(strings.TrimPrefix(request.URL.Path, linkPath))
+	if errLP != nil {
+		linkRender(writer, http.StatusForbidden, &linkPageData{Error: errLP.Error()})
+		return
+	}
+
+	data := &linkPageData{Task: fmtTask(token.task()), Agent: token.Agent, Identity: token.Identity}
+
+	switch request.Method {
+	case "GET":
+		linkRender(writer, http.StatusOK, data)
+	case "POST":
+		approved, errDAL := dbApproveByLink(request.Context(), token)
+		switch errDAL {
+		case nil:
+			log.WithFields(log.Fields{
+				"identity": token.Identity, "agent": token.Agent, "task": fmtTask(token.task()), "approved": approved,
+			}).Info("Approved tasks via link")
+
+			if approved > 0 {
+				approvalHub.publish(token.Agent)
+			}
+
+			data.Done = true
+			data.Approved = approved
+			linkRender(writer, http.StatusOK, data)
+		case linkUsed:
+			linkRender(writer, http.StatusGone, &linkPageData{Error: errDAL.Error()})
+		default:
+			linkRender(writer, http.StatusInternalServerError, &linkPageData{Error: "internal error"})
+		}
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func linkRender(writer http.ResponseWriter, status int, data *linkPageData) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(status)
+	linkPage.Execute(writer, data)
+}
+
+// dbApproveByLink approves the pending tasks token refers to unless it has already been used.
+func dbApproveByLink(ctx context.Context, token *linkToken) (approved int64, err error) {
+	err = dbTx(ctx, "link:"+token.Identity, func(tx *sql.Tx) error {
+		rows, errQuery := dbQuery(tx, `SELECT 1 FROM approval_link WHERE nonce=?`, token.Nonce)
+		if errQuery != nil {
+			return errQuery
+		}
+
+		if len(rows) > 0 {
+			return linkUsed
+		}
+
+		var errAPT error
+		if approved, errAPT = dbApprovePendingTasks(tx, "link:"+token.Identity, token.Agent, token.task()); errAPT != nil {
+			return errAPT
+		}
+
+		_, errExec := dbExec(
+			tx,
+			`
+INSERT INTO approval_link(nonce, identity, agent, package, from_version, to_version, action, approved, ctime)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+`,
+			token.Nonce,
+			token.Identity,
+			dbNullString(token.Agent),
+			token.PackageName,
+			dbNullString(token.FromVersion),
+			dbNullString(token.ToVersion),
+			token.Action,
+			approved,
+			time.Now().Unix(),
+		)
+		if isDuplicateDbError(errExec) {
+			// A concurrent request with the same link has won.
+			return linkUsed
+		}
+
+		return errExec
+	})
+
+	return
+}
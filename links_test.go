@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/masif-upgrader/common"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLinkParse(t *testing.T) {
+	defer testDigestLinks()()
+
+	task := common.PkgMgrTask{PackageName: "nginx", FromVersion: "1", ToVersion: "2", Action: common.PkgMgrUpdate}
+
+	link, errLM := linkMake("mail:ops@example.com", "web01", task)
+	if errLM != nil {
+		t.Fatal(errLM)
+	}
+
+	raw := strings.TrimPrefix(link, approvalLinks.baseUrl+linkPath)
+	parts := strings.Split(raw, ".")
+
+	token, errLP := linkParse(raw)
+	if errLP != nil {
+		t.Fatal(errLP)
+	}
+
+	if token.Identity != "mail:ops@example.com" || token.Agent != "web01" || token.task() != task {
+		t.Errorf("unexpected token: %#v", token)
+	}
+
+	// Same signature, but another agent.
+	jsn, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(jsn), "web01", "web02", 1)))
+
+	flipped := []byte(parts[1])
+	if flipped[0] == 'A' {
+		flipped[0] = 'B'
+	} else {
+		flipped[0] = 'A'
+	}
+
+	for name, bad := range map[string]string{
+		"tampered payload":   tampered + "." + parts[1],
+		"tampered signature": parts[0] + "." + string(flipped),
+		"no signature":       parts[0],
+		"empty signature":    parts[0] + ".",
+		"extra part":         raw + ".x",
+		"signed garbage":     "x." + linkSign("x"),
+		"empty":              "",
+	} {
+		if _, errLP := linkParse(bad); errLP != linkBadToken {
+			t.Errorf("%s: got %v, want %v", name, errLP, linkBadToken)
+		}
+	}
+
+	approvalLinks.secret = []byte("rotated")
+	if _, errLP := linkParse(raw); errLP != linkBadToken {
+		t.Errorf("other secret: got %v, want %v", errLP, linkBadToken)
+	}
+
+	approvalLinks.ttl = -time.Second
+
+	expired, errLM := linkMake("mail:ops@example.com", "web01", task)
+	if errLM != nil {
+		t.Fatal(errLM)
+	}
+
+	if _, errLP := linkParse(strings.TrimPrefix(expired, approvalLinks.baseUrl+linkPath)); errLP != linkExpired {
+		t.Errorf("expired: got %v, want %v", errLP, linkExpired)
+	}
+}
+
+func TestLinkReplay(t *testing.T) {
+	testDb(t)
+	defer testDigestLinks()()
+
+	task := common.PkgMgrTask{PackageName: "nginx", FromVersion: "1", ToVersion: "2", Action: common.PkgMgrUpdate}
+
+	for _, agent := range []string{"web01", "web02"} {
+		_, errUPT := dbUpdatePendingTasks(context.Background(), agent, map[common.PkgMgrTask]struct{}{task: {}})
+		if errUPT != nil {
+			t.Fatal(errUPT)
+		}
+	}
+
+	newToken := func(agent string) *linkToken {
+		link, errLM := linkMake("mail:ops@example.com", agent, task)
+		if errLM != nil {
+			t.Fatal(errLM)
+		}
+
+		token, errLP := linkParse(strings.TrimPrefix(link, approvalLinks.baseUrl+linkPath))
+		if errLP != nil {
+			t.Fatal(errLP)
+		}
+
+		return token
+	}
+
+	token := newToken("web01")
+
+	if approved, errDAL := dbApproveByLink(context.Background(), token); errDAL != nil || approved != 1 {
+		t.Fatalf("got %d approved and %v, want 1 approved", approved, errDAL)
+	}
+
+	if _, errDAL := dbApproveByLink(context.Background(), token); errDAL != linkUsed {
+		t.Errorf("replay: got %v, want %v", errDAL, linkUsed)
+	}
+
+	// Concurrent uses of the same link
+	token = newToken("web02")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+
+	for i := range errs {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = dbApproveByLink(context.Background(), token)
+		}(i)
+	}
+
+	wg.Wait()
+
+	var succeeded int
+
+	for _, errDAL := range errs {
+		switch errDAL {
+		case nil:
+			succeeded++
+		case linkUsed:
+		default:
+			t.Errorf("concurrent use: got %v, want success or %v", errDAL, linkUsed)
+		}
+	}
+
+	if succeeded != 1 {
+		t.Errorf("concurrent use: %d succeeded, want 1", succeeded)
+	}
+}
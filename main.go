@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"flag"
@@ -12,23 +13,58 @@ import (
 	_ "github.com/masif-upgrader/common"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh/terminal"
+	"net"
 	"os"
+	"path"
+	"regexp"
 	"strings"
+	"time"
 )
 
 type settings struct {
 	api struct {
-		listen string
+		listen  string
+		polling pollSettings
 	}
 	tls struct {
-		cert, key, ca, crl string
+		cert, key, ca, crl, ocsp, ocspResponder string
+	}
+	proxy struct {
+		header  string
+		trusted []*net.IPNet
+	}
+	identity struct {
+		source, mapFile string
 	}
 	db struct {
-		typ, dsn string
+		typ, dsn                   string
+		maxRetries                 int
+		startupTimeout             time.Duration
+		maxOpenConns, maxIdleConns int
+		connMaxLifetime            time.Duration
+		queryTimeout               time.Duration
+		replicaDsn                 string
+		replicaMaxLag              time.Duration
 	}
 	log struct {
 		level log.Level
 	}
+	admin struct {
+		listen, users string
+	}
+	metrics struct {
+		listen string
+	}
+	ha struct {
+		instance string
+	}
+	links    *linkSettings
+	quorums  []quorumRule
+	atomic   []string
+	webhooks map[string]*webhook
+	digest   *digestSettings
+	// jobs are the schedules of the background jobs by name.
+	jobs map[string]string
 }
 
 var logLevels = map[string]log.Level{
@@ -68,7 +104,16 @@ func runMaster() error {
 
 	log.SetLevel(cfg.log.level)
 
-	httpd, errNA := newApi(cfg.api.listen, cfg.tls)
+	if flag.NArg() > 0 {
+		return runCli(cfg, flag.Args())
+	}
+
+	identities, errNIM := newIdentityMapper(cfg.identity.source, cfg.identity.mapFile)
+	if errNIM != nil {
+		return errNIM
+	}
+
+	httpd, errNA := newApi(cfg.api.listen, cfg.tls, cfg.proxy, identities)
 	if errNA != nil {
 		return errNA
 	}
@@ -80,23 +125,78 @@ func runMaster() error {
 		return errDB
 	}
 
-	for _, ddl := range mysqlDdls {
-		for {
-			if _, errExec := dbExec(db, ddl); errExec != nil {
-				if isRecoverableDbError(errExec) {
-					continue
-				}
+	if cfg.db.replicaDsn != "" {
+		if replica, errDB = sql.Open(cfg.db.typ, cfg.db.replicaDsn); errDB != nil {
+			return errDB
+		}
+	}
 
-				return errExec
-			}
+	dbConfigure(cfg)
+
+	if errLS := dbLoadSchema(cfg.db.startupTimeout); errLS != nil {
+		return errLS
+	}
+
+	approvalLinks = cfg.links
+	quorums = cfg.quorums
+	polling = cfg.api.polling
+	atomicAgents = cfg.atomic
+
+	go approvalIndexWatch()
 
-			break
+	log.WithFields(log.Fields{"instance": cfg.ha.instance}).Info("Starting leader election")
+
+	go leaderElect(cfg.ha.instance)
+
+	if replica != nil {
+		log.WithFields(log.Fields{"max_lag": cfg.db.replicaMaxLag}).Info("Using read replica")
+
+		go replicaHeartbeat()
+	}
+
+	if webhooks = cfg.webhooks; len(webhooks) > 0 {
+		if errJR := jobRegister("webhooks", cfg.jobs["webhooks"], webhookDeliverDue); errJR != nil {
+			return errJR
 		}
 	}
 
+	if digest := cfg.digest; digest != nil {
+		log.WithFields(log.Fields{"to": digest.to}).Info("Enabling digest")
+
+		errJR := jobRegister("digest", cfg.jobs["digest"], func(ctx context.Context) error {
+			return digestSend(ctx, digest)
+		})
+		if errJR != nil {
+			return errJR
+		}
+	}
+
+	go jobsRun()
+
+	errs := make(chan error, 3)
+
+	if cfg.admin.listen != "" {
+		admind, errNAd := newAdmin(cfg.admin, cfg.tls)
+		if errNAd != nil {
+			return errNAd
+		}
+
+		log.WithFields(log.Fields{"listen": cfg.admin.listen}).Info("Starting admin HTTPd")
+
+		go func() { errs <- admind.ListenAndServeTLS("", "") }()
+	}
+
+	if cfg.metrics.listen != "" {
+		log.WithFields(log.Fields{"listen": cfg.metrics.listen}).Info("Starting metrics HTTPd")
+
+		go func() { errs <- newMetrics(cfg.metrics.listen).ListenAndServe() }()
+	}
+
 	log.Info("Starting HTTPd")
 
-	return httpd.ListenAndServeTLS("", "")
+	go func() { errs <- apiServe(httpd) }()
+
+	return <-errs
 }
 
 func loadCfg() (config *settings, err error) {
@@ -117,18 +217,33 @@ func loadCfg() (config *settings, err error) {
 	cfgTls := cfg.Section("tls")
 	cfgDb := cfg.Section("db")
 	result := &settings{
-		api: struct{ listen string }{
+		api: struct {
+			listen  string
+			polling pollSettings
+		}{
 			listen: cfg.Section("api").Key("listen").String(),
 		},
-		tls: struct{ cert, key, ca, crl string }{
-			cert: cfgTls.Key("cert").String(),
-			key:  cfgTls.Key("key").String(),
-			ca:   cfgTls.Key("ca").String(),
-			crl:  cfgTls.Key("crl").String(),
+		tls: struct{ cert, key, ca, crl, ocsp, ocspResponder string }{
+			cert:          cfgTls.Key("cert").String(),
+			key:           cfgTls.Key("key").String(),
+			ca:            cfgTls.Key("ca").String(),
+			crl:           cfgTls.Key("crl").String(),
+			ocsp:          cfgTls.Key("ocsp").String(),
+			ocspResponder: cfgTls.Key("ocsp_responder").String(),
 		},
-		db: struct{ typ, dsn string }{
-			typ: cfgDb.Key("type").String(),
-			dsn: cfgDb.Key("dsn").String(),
+		db: struct {
+			typ, dsn                   string
+			maxRetries                 int
+			startupTimeout             time.Duration
+			maxOpenConns, maxIdleConns int
+			connMaxLifetime            time.Duration
+			queryTimeout               time.Duration
+			replicaDsn                 string
+			replicaMaxLag              time.Duration
+		}{
+			typ:        cfgDb.Key("type").String(),
+			dsn:        cfgDb.Key("dsn").String(),
+			replicaDsn: cfgDb.Key("replica_dsn").String(),
 		},
 	}
 
@@ -136,18 +251,75 @@ func loadCfg() (config *settings, err error) {
 		return nil, errors.New("config: api.listen missing")
 	}
 
-	if result.tls.cert == "" {
-		return nil, errors.New("config: tls.cert missing")
+	cfgApi := cfg.Section("api")
+
+	if rawInterval := cfgApi.Key("poll_interval").String(); rawInterval == "" {
+		result.api.polling.interval = time.Minute
+	} else if interval, errDr := cfgApi.Key("poll_interval").Duration(); errDr == nil && interval > 0 {
+		result.api.polling.interval = interval
+	} else {
+		return nil, errors.New("config: bad api.poll_interval")
+	}
+
+	if rawMaxConcurrent := cfgApi.Key("max_concurrent").String(); rawMaxConcurrent == "" {
+		result.api.polling.maxConcurrent = 100
+	} else if maxConcurrent, errInt := cfgApi.Key("max_concurrent").Int64(); errInt == nil && maxConcurrent > 0 {
+		result.api.polling.maxConcurrent = maxConcurrent
+	} else {
+		return nil, errors.New("config: bad api.max_concurrent")
 	}
 
-	if result.tls.key == "" {
-		return nil, errors.New("config: tls.key missing")
+	if rawMaxWait := cfgApi.Key("max_wait").String(); rawMaxWait == "" {
+		result.api.polling.maxWait = 5 * time.Minute
+	} else if maxWait, errDr := cfgApi.Key("max_wait").Duration(); errDr == nil && maxWait >= 0 {
+		result.api.polling.maxWait = maxWait
+	} else {
+		return nil, errors.New("config: bad api.max_wait")
+	}
+
+	cfgProxy := cfg.Section("proxy")
+	result.proxy.header = cfgProxy.Key("header").String()
+
+	if result.proxy.header == "" {
+		if result.tls.cert == "" {
+			return nil, errors.New("config: tls.cert missing")
+		}
+
+		if result.tls.key == "" {
+			return nil, errors.New("config: tls.key missing")
+		}
+	} else if !strings.HasPrefix(result.api.listen, "unix:") {
+		trusted, errPPT := proxyParseTrusted(cfgProxy.Key("trusted").String())
+		if errPPT != nil {
+			return nil, errors.New("config: bad proxy.trusted: " + errPPT.Error())
+		}
+
+		if len(trusted) < 1 {
+			return nil, errors.New("config: proxy.trusted missing")
+		}
+
+		result.proxy.trusted = trusted
 	}
 
 	if result.tls.ca == "" {
 		return nil, errors.New("config: tls.ca missing")
 	}
 
+	switch result.tls.ocsp {
+	case "", "off", "soft", "hard":
+	default:
+		return nil, errors.New("config: bad tls.ocsp")
+	}
+
+	cfgIdentity := cfg.Section("identity")
+	result.identity.mapFile = cfgIdentity.Key("map").String()
+
+	if result.identity.source = cfgIdentity.Key("source").String(); result.identity.source == "" {
+		result.identity.source = "cn"
+	} else if _, sourceValid := identitySources[result.identity.source]; !sourceValid {
+		return nil, errors.New("config: bad identity.source")
+	}
+
 	if result.db.typ == "" {
 		return nil, errors.New("config: db.type missing")
 	}
@@ -156,6 +328,222 @@ func loadCfg() (config *settings, err error) {
 		return nil, errors.New("config: db.dsn missing")
 	}
 
+	if rawMaxRetries := cfgDb.Key("max_retries").String(); rawMaxRetries == "" {
+		result.db.maxRetries = 10
+	} else if maxRetries, errInt := cfgDb.Key("max_retries").Int(); errInt == nil && maxRetries >= 0 {
+		result.db.maxRetries = maxRetries
+	} else {
+		return nil, errors.New("config: bad db.max_retries")
+	}
+
+	if rawStartupTimeout := cfgDb.Key("startup_timeout").String(); rawStartupTimeout == "" {
+		result.db.startupTimeout = 5 * time.Minute
+	} else if startupTimeout, errDr := cfgDb.Key("startup_timeout").Duration(); errDr == nil && startupTimeout > 0 {
+		result.db.startupTimeout = startupTimeout
+	} else {
+		return nil, errors.New("config: bad db.startup_timeout")
+	}
+
+	if rawMaxOpenConns := cfgDb.Key("max_open_conns").String(); rawMaxOpenConns != "" {
+		maxOpenConns, errInt := cfgDb.Key("max_open_conns").Int()
+		if errInt != nil || maxOpenConns < 0 {
+			return nil, errors.New("config: bad db.max_open_conns")
+		}
+
+		// The leader holds one connection all the time.
+		if maxOpenConns == 1 {
+			return nil, errors.New("config: db.max_open_conns must be at least 2")
+		}
+
+		result.db.maxOpenConns = maxOpenConns
+	}
+
+	if rawMaxIdleConns := cfgDb.Key("max_idle_conns").String(); rawMaxIdleConns == "" {
+		result.db.maxIdleConns = 2
+	} else if maxIdleConns, errInt := cfgDb.Key("max_idle_conns").Int(); errInt == nil && maxIdleConns >= 0 {
+		result.db.maxIdleConns = maxIdleConns
+	} else {
+		return nil, errors.New("config: bad db.max_idle_conns")
+	}
+
+	result.db.replicaMaxLag = 30 * time.Second
+
+	if result.db.maxOpenConns > 0 && result.db.maxIdleConns > result.db.maxOpenConns {
+		return nil, errors.New("config: db.max_idle_conns exceeds db.max_open_conns")
+	}
+
+	for _, option := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"conn_max_lifetime", &result.db.connMaxLifetime},
+		{"query_timeout", &result.db.queryTimeout},
+		{"replica_max_lag", &result.db.replicaMaxLag},
+	} {
+		if cfgDb.Key(option.name).String() != "" {
+			value, errDr := cfgDb.Key(option.name).Duration()
+			if errDr != nil || value < 0 {
+				return nil, errors.New("config: bad db." + option.name)
+			}
+
+			*option.value = value
+		}
+	}
+
+	if result.ha.instance = cfg.Section("ha").Key("instance").String(); result.ha.instance == "" {
+		hostname, errHn := os.Hostname()
+		if errHn != nil {
+			return nil, errors.New("config: ha.instance missing and hostname unknown: " + errHn.Error())
+		}
+
+		result.ha.instance = hostname
+	}
+
+	result.metrics.listen = cfg.Section("metrics").Key("listen").String()
+
+	result.admin.users = cfg.Section("admin").Key("users").String()
+
+	if result.admin.listen = cfg.Section("admin").Key("listen").String(); result.admin.listen != "" {
+		if result.tls.cert == "" {
+			return nil, errors.New("config: tls.cert missing")
+		}
+
+		if result.tls.key == "" {
+			return nil, errors.New("config: tls.key missing")
+		}
+	}
+
+	if cfgLinks := cfg.Section("links"); cfgLinks.Key("secret").String() != "" {
+		result.links = &linkSettings{
+			secret:  []byte(cfgLinks.Key("secret").String()),
+			baseUrl: cfgLinks.Key("base_url").String(),
+		}
+
+		if result.admin.listen == "" {
+			return nil, errors.New("config: admin.listen missing")
+		}
+
+		if result.links.baseUrl == "" {
+			return nil, errors.New("config: links.base_url missing")
+		}
+
+		ttl, errDr := cfgLinks.Key("ttl").Duration()
+		if rawTtl := cfgLinks.Key("ttl").String(); rawTtl == "" {
+			ttl = 24 * time.Hour
+		} else if errDr != nil || ttl <= 0 {
+			return nil, errors.New("config: bad links.ttl")
+		}
+
+		result.links.ttl = ttl
+	}
+	for _, key := range cfg.Section("quorum").Keys() {
+		n, errInt := key.Int()
+		if errInt != nil || n < 1 {
+			return nil, errors.New("config: bad quorum." + key.Name())
+		}
+
+		if _, errPM := path.Match(key.Name(), ""); errPM != nil {
+			return nil, errors.New("config: bad quorum pattern: " + key.Name())
+		}
+
+		result.quorums = append(result.quorums, quorumRule{pattern: key.Name(), n: n})
+	}
+
+	for _, pattern := range cfg.Section("atomic").Key("agents").Strings(",") {
+		if _, errPM := path.Match(pattern, ""); errPM != nil {
+			return nil, errors.New("config: bad atomic.agents pattern: " + pattern)
+		}
+
+		result.atomic = append(result.atomic, pattern)
+	}
+
+	result.webhooks = map[string]*webhook{}
+
+	for _, section := range cfg.Sections() {
+		if name := strings.TrimPrefix(section.Name(), "webhook."); name != section.Name() {
+			hook := &webhook{
+				name:   name,
+				url:    section.Key("url").String(),
+				secret: section.Key("secret").String(),
+				events: webhookEvents,
+			}
+
+			if hook.url == "" {
+				return nil, errors.New("config: " + section.Name() + ".url missing")
+			}
+
+			if rawEvents := section.Key("events").Strings(","); len(rawEvents) > 0 {
+				hook.events = map[string]struct{}{}
+
+				for _, event := range rawEvents {
+					if _, eventValid := webhookEvents[event]; !eventValid {
+						return nil, errors.New("config: bad " + section.Name() + ".events")
+					}
+
+					hook.events[event] = struct{}{}
+				}
+			}
+
+			result.webhooks[name] = hook
+		}
+	}
+
+	result.jobs = make(map[string]string, len(jobDefaults))
+	for name, expr := range jobDefaults {
+		result.jobs[name] = expr
+	}
+
+	if digestTo := cfg.Section("digest").Key("to").Strings(","); len(digestTo) > 0 {
+		cfgSmtp := cfg.Section("smtp")
+		cfgDigest := cfg.Section("digest")
+
+		result.digest = &digestSettings{to: digestTo}
+		result.digest.smtp.host = cfgSmtp.Key("host").String()
+		result.digest.smtp.port = cfgSmtp.Key("port").MustString("25")
+		result.digest.smtp.username = cfgSmtp.Key("username").String()
+		result.digest.smtp.password = cfgSmtp.Key("password").String()
+		result.digest.smtp.from = cfgSmtp.Key("from").String()
+
+		if result.digest.smtp.host == "" {
+			return nil, errors.New("config: smtp.host missing")
+		}
+
+		if result.digest.smtp.from == "" {
+			return nil, errors.New("config: smtp.from missing")
+		}
+
+		// digest.at predates the jobs section.
+		if rawAt := cfgDigest.Key("at").String(); rawAt != "" {
+			at, errTP := time.Parse("15:04", rawAt)
+			if errTP != nil || len(rawAt) != 5 {
+				return nil, errors.New("config: bad digest.at")
+			}
+
+			result.jobs["digest"] = fmt.Sprintf("%d %d * * *", at.Minute(), at.Hour())
+		}
+
+		if rawSecurity := cfgDigest.Key("security").String(); rawSecurity != "" {
+			security, errRC := regexp.Compile(rawSecurity)
+			if errRC != nil {
+				return nil, errors.New("config: bad digest.security: " + errRC.Error())
+			}
+
+			result.digest.security = security
+		}
+	}
+
+	for _, key := range cfg.Section("jobs").Keys() {
+		if _, known := jobDefaults[key.Name()]; !known {
+			return nil, errors.New("config: unknown job: " + key.Name())
+		}
+
+		if _, errCP := cronParse(key.String()); errCP != nil {
+			return nil, errors.New("config: bad jobs." + key.Name() + ": " + errCP.Error())
+		}
+
+		result.jobs[key.Name()] = key.String()
+	}
+
 	if rawLogLvl := cfg.Section("log").Key("level").String(); rawLogLvl == "" {
 		result.log.level = log.InfoLevel
 	} else if logLvl, logLvlValid := logLevels[rawLogLvl]; logLvlValid {
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type metric struct {
+	name, help, typ string
+	samples         func() map[string]float64
+}
+
+type metricsCounter struct {
+	value uint64
+}
+
+func (c *metricsCounter) inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *metricsCounter) add(delta uint64) {
+	atomic.AddUint64(&c.value, delta)
+}
+
+func (c *metricsCounter) get() float64 {
+	return float64(atomic.LoadUint64(&c.value))
+}
+
+var metricsMutex = sync.RWMutex{}
+var metrics []*metric = nil
+
+// metricsRegister adds a metric family. samples returns the values keyed by their rendered labels, e.g. `{a="b"}`.
+func metricsRegister(name, help, typ string, samples func() map[string]float64) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	metrics = append(metrics, &metric{name: "masif_upgrader_master_" + name, help: help, typ: typ, samples: samples})
+}
+
+func metricsRegisterCounter(name, help string) *metricsCounter {
+	counter := &metricsCounter{}
+
+	metricsRegister(name, help, "counter", func() map[string]float64 {
+		return map[string]float64{"": counter.get()}
+	})
+
+	return counter
+}
+
+func metricsRegisterGauge(name, help string, value func() float64) {
+	metricsRegister(name, help, "gauge", func() map[string]float64 {
+		return map[string]float64{"": value()}
+	})
+}
+
+func newMetrics(listen string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/health", leaderHealth)
+	mux.HandleFunc("/", apiDefault)
+
+	return &http.Server{Addr: listen, Handler: mux}
+}
+
+func metricsHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+
+	metricsMutex.RLock()
+
+	for _, m := range metrics {
+		samples := m.samples()
+		labels := make([]string, 0, len(samples))
+
+		for label := range samples {
+			labels = append(labels, label)
+		}
+
+		sort.Strings(labels)
+
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+
+		for _, label := range labels {
+			fmt.Fprintf(buf, "%s%s %g\n", m.name, label, samples[label])
+		}
+	}
+
+	metricsMutex.RUnlock()
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(buf.Bytes())
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const ocspTimeout = 10 * time.Second
+
+// ocspClockSkew is how far an OCSP response's thisUpdate may be in the future.
+const ocspClockSkew = time.Minute
+
+var ocspRevoked = errors.New("all certificates of the remote's TLS certificate chain have been revoked according to OCSP")
+
+var ocspNoResponder = errors.New("neither the certificate nor the config specifies an OCSP responder")
+
+var ocspNoChain = errors.New("no certificate chain with an issuer to check via OCSP")
+
+var ocspStale = errors.New("OCSP response is outside of its validity period")
+
+var ocspLookups = metricsRegisterCounter("ocsp_lookups_total", "OCSP requests sent to responders")
+var ocspLookupErrors = metricsRegisterCounter("ocsp_lookup_errors_total", "Failed OCSP requests")
+
+type ocspCacheEntry struct {
+	status  int
+	expires time.Time
+}
+
+type ocspChecker struct {
+	// hardFail rejects certificates with unknown status instead of just warning.
+	hardFail  bool
+	responder string
+	client    *http.Client
+
+	mutex sync.Mutex
+	cache map[string]ocspCacheEntry
+}
+
+func newOcspChecker(mode, responder string) *ocspChecker {
+	return &ocspChecker{
+		hardFail:  mode == "hard",
+		responder: responder,
+		client:    &http.Client{Timeout: ocspTimeout},
+		cache:     map[string]ocspCacheEntry{},
+	}
+}
+
+func (c *ocspChecker) validator() func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		log.Debug("Checking the remote's TLS certificate via OCSP")
+
+		var lastErr error = nil
+		revoked := false
+
+		for _, chain := range verifiedChains {
+			if len(chain) < 2 {
+				continue
+			}
+
+			status, errSt := c.status(chain[0], chain[1])
+			if errSt != nil {
+				lastErr = errSt
+				continue
+			}
+
+			switch status {
+			case ocsp.Good:
+				log.Debug("OCSP responder considers the remote's TLS certificate good")
+				return nil
+			case ocsp.Revoked:
+				revoked = true
+			case ocsp.Unknown:
+				lastErr = errors.New("OCSP responder doesn't know the remote's TLS certificate")
+			}
+		}
+
+		// A revocation wins over lookup errors for other chains, even in soft mode.
+		if revoked {
+			log.Warn("OCSP responder considers the remote's TLS certificate revoked")
+			return ocspRevoked
+		}
+
+		if lastErr == nil {
+			lastErr = ocspNoChain
+		}
+
+		if c.hardFail {
+			log.WithFields(log.Fields{"error": lastErr}).Warn("Couldn't verify the remote's TLS certificate via OCSP")
+			return lastErr
+		}
+
+		log.WithFields(log.Fields{"error": lastErr}).Warn(
+			"Couldn't verify the remote's TLS certificate via OCSP, accepting it anyway",
+		)
+
+		return nil
+	}
+}
+
+// status returns the OCSP status of cert issued by issuer, from the cache if not expired.
+func (c *ocspChecker) status(cert, issuer *x509.Certificate) (int, error) {
+	key := fmt.Sprintf("%x/%s", issuer.RawSubjectPublicKeyInfo, cert.SerialNumber.Text(16))
+	now := time.Now()
+
+	c.mutex.Lock()
+	cached, isCached := c.cache[key]
+	c.mutex.Unlock()
+
+	if isCached && now.Before(cached.expires) {
+		return cached.status, nil
+	}
+
+	response, errLU := c.lookup(cert, issuer)
+	if errLU != nil {
+		ocspLookupErrors.inc()
+		return 0, errLU
+	}
+
+	// Once revoked a certificate stays revoked, so only non-revocations have to be fresh.
+	if response.Status != ocsp.Revoked && (response.ThisUpdate.After(now.Add(ocspClockSkew)) ||
+		!response.NextUpdate.IsZero() && !now.Before(response.NextUpdate)) {
+		ocspLookupErrors.inc()
+		return 0, ocspStale
+	}
+
+	c.mutex.Lock()
+
+	if response.NextUpdate.IsZero() {
+		delete(c.cache, key)
+	} else {
+		c.cache[key] = ocspCacheEntry{status: response.Status, expires: response.NextUpdate}
+	}
+
+	for key, entry := range c.cache {
+		if !now.Before(entry.expires) {
+			delete(c.cache, key)
+		}
+	}
+
+	c.mutex.Unlock()
+
+	return response.Status, nil
+}
+
+func (c *ocspChecker) lookup(cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	responder := c.responder
+	if responder == "" {
+		if len(cert.OCSPServer) < 1 {
+			return nil, ocspNoResponder
+		}
+
+		responder = cert.OCSPServer[0]
+	}
+
+	request, errCR := ocsp.CreateRequest(cert, issuer, nil)
+	if errCR != nil {
+		return nil, errCR
+	}
+
+	log.WithFields(log.Fields{
+		"responder": responder, "serial": cert.SerialNumber.Text(16),
+	}).Debug("Querying OCSP responder")
+
+	ocspLookups.inc()
+
+	response, errPost := c.client.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if errPost != nil {
+		return nil, errPost
+	}
+
+	defer response.Body.Close()
+
+	body, errRA := ioutil.ReadAll(response.Body)
+	if errRA != nil {
+		return nil, errRA
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s returned HTTP %d", responder, response.StatusCode)
+	}
+
+	return ocsp.ParseResponseForCert(body, cert, issuer)
+}
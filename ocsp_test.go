@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/x509"
+	"golang.org/x/crypto/ocsp"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestOcspResponder answers every request for pki's certificates per template.
+func newTestOcspResponder(t *testing.T, pki *testPki, template ocsp.Response) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, errRA := ioutil.ReadAll(r.Body)
+		if errRA != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		request, errPR := ocsp.ParseRequest(body)
+		if errPR != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		template.SerialNumber = request.SerialNumber
+		if template.Status == ocsp.Revoked {
+			template.RevokedAt = time.Now().Add(-time.Hour)
+		}
+
+		response, errCR := ocsp.CreateResponse(pki.ca, pki.ca, template, pki.key)
+		if errCR != nil {
+			t.Error(errCR)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(response)
+	}))
+}
+
+// newTestOcspChain issues a certificate pointing to responder.
+func newTestOcspChain(t *testing.T, responder string) (*testPki, []*x509.Certificate) {
+	pki := newTestPki(t, "OCSP CA")
+	cert := pki.issue(t, "agent.example.com", func(template *x509.Certificate) {
+		template.OCSPServer = []string{responder}
+	})
+
+	return pki, []*x509.Certificate{cert, pki.ca}
+}
+
+func TestOcspChecker(t *testing.T) {
+	now := time.Now()
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	// Outcomes of the validator
+	const (
+		accepted = iota
+		revoked
+		failed
+	)
+
+	cases := []struct {
+		name       string
+		response   *ocsp.Response
+		hard, soft int
+	}{
+		{"good", &ocsp.Response{Status: ocsp.Good, ThisUpdate: now, NextUpdate: now.Add(time.Hour)}, accepted, accepted},
+		{"good without nextUpdate", &ocsp.Response{Status: ocsp.Good, ThisUpdate: now}, accepted, accepted},
+		{"revoked", &ocsp.Response{Status: ocsp.Revoked, ThisUpdate: now, NextUpdate: now.Add(time.Hour)}, revoked, revoked},
+		{"unknown", &ocsp.Response{Status: ocsp.Unknown, ThisUpdate: now, NextUpdate: now.Add(time.Hour)}, failed, accepted},
+		{
+			"stale",
+			&ocsp.Response{Status: ocsp.Good, ThisUpdate: now.Add(-2 * time.Hour), NextUpdate: now.Add(-time.Hour)},
+			failed, accepted,
+		},
+		{
+			"from the future",
+			&ocsp.Response{Status: ocsp.Good, ThisUpdate: now.Add(time.Hour), NextUpdate: now.Add(2 * time.Hour)},
+			failed, accepted,
+		},
+		{
+			"stale revoked",
+			&ocsp.Response{Status: ocsp.Revoked, ThisUpdate: now.Add(-2 * time.Hour), NextUpdate: now.Add(-time.Hour)},
+			revoked, revoked,
+		},
+		{"unreachable", nil, failed, accepted},
+	}
+
+	for _, c := range cases {
+		for mode, want := range map[string]int{"hard": c.hard, "soft": c.soft} {
+			t.Run(c.name+"/"+mode, func(t *testing.T) {
+				url := unreachable.URL
+				var chain []*x509.Certificate
+
+				if c.response == nil {
+					_, chain = newTestOcspChain(t, url)
+				} else {
+					// The responder URL isn't known before the server is up, so use the checker's override.
+					var pki *testPki
+					pki, chain = newTestOcspChain(t, "")
+
+					responder := newTestOcspResponder(t, pki, *c.response)
+					defer responder.Close()
+
+					url = responder.URL
+				}
+
+				errVal := newOcspChecker(mode, url).validator()(nil, [][]*x509.Certificate{chain})
+
+				switch want {
+				case accepted:
+					if errVal != nil {
+						t.Errorf("got %v, want success", errVal)
+					}
+				case revoked:
+					if errVal != ocspRevoked {
+						t.Errorf("got %v, want %v", errVal, ocspRevoked)
+					}
+				case failed:
+					if errVal == nil || errVal == ocspRevoked {
+						t.Errorf("got %v, want lookup error", errVal)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestOcspCheckerRevocationWinsOverErrors(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	revokedPki := newTestPki(t, "Revoking CA")
+	responder := newTestOcspResponder(t, revokedPki, ocsp.Response{
+		Status: ocsp.Revoked, ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour),
+	})
+	defer responder.Close()
+
+	revoked := revokedPki.issue(t, "agent.example.com", func(template *x509.Certificate) {
+		template.OCSPServer = []string{responder.URL}
+	})
+
+	_, failing := newTestOcspChain(t, unreachable.URL)
+
+	for _, mode := range []string{"soft", "hard"} {
+		for _, chains := range [][][]*x509.Certificate{
+			{{revoked, revokedPki.ca}, failing},
+			{failing, {revoked, revokedPki.ca}},
+		} {
+			if errVal := newOcspChecker(mode, "").validator()(nil, chains); errVal != ocspRevoked {
+				t.Errorf("%s: got %v, want %v", mode, errVal, ocspRevoked)
+			}
+		}
+	}
+}
+
+func TestOcspCheckerCachesUntilNextUpdate(t *testing.T) {
+	pki, chain := newTestOcspChain(t, "")
+	requests := 0
+
+	template := ocsp.Response{Status: ocsp.Good, ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+	responder := newTestOcspResponder(t, pki, template)
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		responder.Config.Handler.ServeHTTP(w, r)
+	}))
+
+	defer responder.Close()
+	defer counting.Close()
+
+	checker := newOcspChecker("hard", counting.URL)
+
+	for i := 0; i < 3; i++ {
+		if errVal := checker.validator()(nil, [][]*x509.Certificate{chain}); errVal != nil {
+			t.Fatal(errVal)
+		}
+	}
+
+	if requests != 1 {
+		t.Errorf("got %d OCSP requests, want 1", requests)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testPki is a throwaway CA for tests.
+type testPki struct {
+	ca     *x509.Certificate
+	key    crypto.Signer
+	serial int64
+}
+
+func newTestPki(t testing.TB, name string) *testPki {
+	t.Helper()
+
+	key, errGK := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if errGK != nil {
+		t.Fatal(errGK)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, errCC := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if errCC != nil {
+		t.Fatal(errCC)
+	}
+
+	ca, errPC := x509.ParseCertificate(der)
+	if errPC != nil {
+		t.Fatal(errPC)
+	}
+
+	return &testPki{ca: ca, key: key, serial: 1}
+}
+
+// issue signs a client certificate for cn, customize may amend the template.
+func (p *testPki) issue(t testing.TB, cn string, customize func(template *x509.Certificate)) *x509.Certificate {
+	t.Helper()
+
+	key, errGK := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if errGK != nil {
+		t.Fatal(errGK)
+	}
+
+	p.serial++
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	if customize != nil {
+		customize(template)
+	}
+
+	der, errCC := x509.CreateCertificate(rand.Reader, template, p.ca, key.Public(), p.key)
+	if errCC != nil {
+		t.Fatal(errCC)
+	}
+
+	cert, errPC := x509.ParseCertificate(der)
+	if errPC != nil {
+		t.Fatal(errPC)
+	}
+
+	return cert
+}
+
+func (p *testPki) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(p.ca)
+	return pool
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"github.com/go-sql-driver/mysql"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// pollSettings control when agents are told to come back.
+type pollSettings struct {
+	interval time.Duration
+	// maxConcurrent limits the agent requests handled at once, more are told to come back later.
+	maxConcurrent int64
+	// maxWait limits how long agents may long-poll.
+	maxWait time.Duration
+}
+
+// pollMaxBackoff is the factor the poll interval is stretched by under full load.
+const pollMaxBackoff = 5
+
+var polling pollSettings
+
+var pollInFlight int64 = 0
+
+var pollOverloads = metricsRegisterCounter("api_overloads_total", "Agent requests answered 503 due to overload")
+
+func init() {
+	metricsRegisterGauge("api_requests_in_flight", "Agent requests being handled", func() float64 {
+		return float64(atomic.LoadInt64(&pollInFlight))
+	})
+}
+
+// pollAcquire tells whether another agent request may be handled now. If so, pollRelease must follow.
+func pollAcquire() bool {
+	if atomic.AddInt64(&pollInFlight, 1) > polling.maxConcurrent {
+		atomic.AddInt64(&pollInFlight, -1)
+		return false
+	}
+
+	return true
+}
+
+func pollRelease() {
+	atomic.AddInt64(&pollInFlight, -1)
+}
+
+// pollNext returns when an agent should poll again based on the current load, jittered by 10%
+// not to let all agents come back at once.
+func pollNext() time.Duration {
+	load := math.Min(float64(atomic.LoadInt64(&pollInFlight))/float64(polling.maxConcurrent), 1)
+	next := float64(polling.interval) * (1 + (pollMaxBackoff-1)*load)
+
+	return time.Duration(next * (0.9 + 0.2*rand.Float64()))
+}
+
+// pollSetRetryAfter tells the agent via the Retry-After header when to come back and returns that point in time.
+func pollSetRetryAfter(writer http.ResponseWriter, after time.Duration) time.Time {
+	writer.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(after.Seconds())), 10))
+	return time.Now().Add(after)
+}
+
+// pollOverload answers 503 telling the agent to come back much later.
+func pollOverload(writer http.ResponseWriter) {
+	pollOverloads.inc()
+
+	after := time.Duration(float64(polling.interval*pollMaxBackoff) * (0.9 + 0.2*rand.Float64()))
+	pollSetRetryAfter(writer, after)
+	writer.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// isOverloadDbError tells whether e says that the database can't take more load.
+// That includes deadlocks and lock wait timeouts which persisted after all retries
+// as well as statements exceeding the query timeout.
+func isOverloadDbError(e error) bool {
+	if e == context.DeadlineExceeded {
+		return true
+	}
+
+	if errDb, ok := e.(*mysql.MySQLError); ok {
+		switch errDb.Number {
+		case 1040, 1203, 1205, 1213, 3024:
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"testing"
+)
+
+func TestIsOverloadDbError(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{&mysql.MySQLError{Number: 1040}, true},
+		{&mysql.MySQLError{Number: 1203}, true},
+		{&mysql.MySQLError{Number: 1205}, true},
+		{&mysql.MySQLError{Number: 1213}, true},
+		{&mysql.MySQLError{Number: 3024}, true},
+		{context.DeadlineExceeded, true},
+		{&mysql.MySQLError{Number: 1062}, false},
+		{&mysql.MySQLError{Number: 1146}, false},
+		{context.Canceled, false},
+		{driver.ErrBadConn, false},
+		{errors.New("something else"), false},
+	} {
+		if got := isOverloadDbError(c.err); got != c.want {
+			t.Errorf("%v: got %t, want %t", c.err, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var proxyNoCert = errors.New("no certificate in forwarded header")
+
+type proxyChainsContextKey struct{}
+
+// proxyVerifier accepts client certificates forwarded by TLS-terminating reverse proxies.
+type proxyVerifier struct {
+	header  string
+	trusted []*net.IPNet
+	// unix trusts every peer as access to Unix sockets is controlled by file permissions.
+	unix      bool
+	roots     *x509.CertPool
+	validator func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+}
+
+func proxyParseTrusted(raw string) (nets []*net.IPNet, err error) {
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.New("bad IP address: " + entry)
+			}
+
+			if ip.To4() == nil {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+
+		_, ipNet, errPC := net.ParseCIDR(entry)
+		if errPC != nil {
+			return nil, errPC
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return
+}
+
+func (p *proxyVerifier) isTrusted(remoteAddr string) bool {
+	if p.unix {
+		return true
+	}
+
+	host, _, errSHP := net.SplitHostPort(remoteAddr)
+	if errSHP != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range p.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyParseCert parses either URL-escaped PEM (e.g. nginx' $ssl_client_escaped_cert)
+// or base64-encoded DER (e.g. HAProxy's %[ssl_c_der,base64]).
+func proxyParseCert(value string) (*x509.Certificate, error) {
+	if value == "" {
+		return nil, proxyNoCert
+	}
+
+	if unescaped, errPU := url.PathUnescape(value); errPU == nil && strings.Contains(unescaped, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(unescaped))
+		if block == nil {
+			return nil, proxyNoCert
+		}
+
+		return x509.ParseCertificate(block.Bytes)
+	}
+
+	der, errDS := base64.StdEncoding.DecodeString(value)
+	if errDS != nil {
+		return nil, errDS
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// middleware verifies the forwarded client certificate just like a direct TLS handshake would.
+func (p *proxyVerifier) middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !p.isTrusted(r.RemoteAddr) {
+			log.WithFields(log.Fields{"remote": r.RemoteAddr}).Warn("Rejecting request from untrusted proxy")
+
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		cert, errPC := proxyParseCert(r.Header.Get(p.header))
+		if errPC != nil {
+			log.WithFields(log.Fields{"remote": r.RemoteAddr, "error": errPC}).Warn("Bad forwarded TLS client cert")
+
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(errPC.Error()))
+			return
+		}
+
+		// Proxies forward only the leaf, so there are no intermediates to verify with.
+		chains, errVf := cert.Verify(x509.VerifyOptions{
+			Roots:     p.roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if errVf == nil && p.validator != nil {
+			errVf = p.validator([][]byte{cert.Raw}, chains)
+		}
+
+		if errVf != nil {
+			log.WithFields(log.Fields{"remote": r.RemoteAddr, "error": errVf}).Warn("Rejecting forwarded TLS client cert")
+
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyChainsContextKey{}, chains)))
+	})
+}
+
+// proxyVerifiedChains returns the client's verified certificate chains
+// from either the TLS connection or proxyVerifier.middleware.
+func proxyVerifiedChains(r *http.Request) [][]*x509.Certificate {
+	if chains, ok := r.Context().Value(proxyChainsContextKey{}).([][]*x509.Certificate); ok {
+		return chains
+	}
+
+	if r.TLS != nil {
+		return r.TLS.VerifiedChains
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProxyIsTrusted(t *testing.T) {
+	trusted, errPPT := proxyParseTrusted("192.0.2.1, 198.51.100.0/24,2001:db8::1")
+	if errPPT != nil {
+		t.Fatal(errPPT)
+	}
+
+	proxy := &proxyVerifier{trusted: trusted}
+
+	for remoteAddr, want := range map[string]bool{
+		"192.0.2.1:1234":         true,
+		"192.0.2.2:1234":         false,
+		"198.51.100.42:1234":     true,
+		"[2001:db8::1]:1234":     true,
+		"[2001:db8::2]:1234":     false,
+		"192.0.2.1":              false,
+		"not an address:1234":    false,
+		"[::ffff:192.0.2.1]:123": true,
+	} {
+		if got := proxy.isTrusted(remoteAddr); got != want {
+			t.Errorf("%s: got %t, want %t", remoteAddr, got, want)
+		}
+	}
+
+	if !(&proxyVerifier{unix: true}).isTrusted("@") {
+		t.Error("Unix socket peers should be trusted")
+	}
+}
+
+func TestProxyParseCert(t *testing.T) {
+	cert := newTestPki(t, "Proxy CA").issue(t, "agent.example.com", nil)
+	pemCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+
+	for _, value := range []string{
+		url.PathEscape(pemCert),
+		base64.StdEncoding.EncodeToString(cert.Raw),
+	} {
+		parsed, errPC := proxyParseCert(value)
+		if errPC != nil {
+			t.Errorf("%q: %s", value, errPC.Error())
+		} else if !parsed.Equal(cert) {
+			t.Errorf("%q: parsed another certificate", value)
+		}
+	}
+
+	for _, value := range []string{
+		"",
+		url.PathEscape("-----BEGIN CERTIFICATE-----\nnot base64\n-----END CERTIFICATE-----\n"),
+		url.PathEscape(pemCert[:len(pemCert)/2]),
+		url.PathEscape(pemCert)[:len(url.PathEscape(pemCert))-10] + "%ZZ",
+		"not base64!",
+		base64.StdEncoding.EncodeToString(cert.Raw[:len(cert.Raw)/2]),
+	} {
+		if _, errPC := proxyParseCert(value); errPC == nil {
+			t.Errorf("%q: parsed, want error", value)
+		}
+	}
+}
+
+func TestProxyMiddleware(t *testing.T) {
+	pki := newTestPki(t, "Proxy CA")
+	good := pki.issue(t, "good.example.com", nil)
+	revoked := pki.issue(t, "revoked.example.com", nil)
+	foreign := newTestPki(t, "Foreign CA").issue(t, "foreign.example.com", nil)
+
+	dir, errTD := ioutil.TempDir("", "masif-upgrader-master")
+	if errTD != nil {
+		t.Fatal(errTD)
+	}
+
+	defer os.RemoveAll(dir)
+
+	crl, errCC := pki.ca.CreateCRL(
+		rand.Reader, pki.key,
+		[]pkix.RevokedCertificate{{SerialNumber: revoked.SerialNumber, RevocationTime: time.Now()}},
+		time.Now(), time.Now().Add(time.Hour),
+	)
+	if errCC != nil {
+		t.Fatal(errCC)
+	}
+
+	crlFile := filepath.Join(dir, "crl.pem")
+	if errWF := ioutil.WriteFile(crlFile, crl, 0600); errWF != nil {
+		t.Fatal(errWF)
+	}
+
+	crls, errNCS := newCrlStore(crlFile, []*x509.Certificate{pki.ca})
+	if errNCS != nil {
+		t.Fatal(errNCS)
+	}
+
+	trusted, _ := proxyParseTrusted("192.0.2.1")
+	proxy := &proxyVerifier{
+		header: "X-SSL-Client-Cert", trusted: trusted, roots: pki.pool(), validator: crls.validator(),
+	}
+
+	var passed [][]*x509.Certificate
+	handler := proxy.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passed = proxyVerifiedChains(r)
+	}))
+
+	cases := []struct {
+		name, remoteAddr, header string
+		want                     int
+	}{
+		{"good", "192.0.2.1:1234", base64.StdEncoding.EncodeToString(good.Raw), http.StatusOK},
+		{"untrusted proxy", "192.0.2.2:1234", base64.StdEncoding.EncodeToString(good.Raw), http.StatusForbidden},
+		{"no cert", "192.0.2.1:1234", "", http.StatusBadRequest},
+		{"malformed", "192.0.2.1:1234", "%ZZ-----BEGIN", http.StatusBadRequest},
+		{"foreign CA", "192.0.2.1:1234", base64.StdEncoding.EncodeToString(foreign.Raw), http.StatusForbidden},
+		{"revoked", "192.0.2.1:1234", base64.StdEncoding.EncodeToString(revoked.Raw), http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		passed = nil
+
+		request := httptest.NewRequest("POST", "/v1/pending-tasks", nil)
+		request.RemoteAddr = c.remoteAddr
+		request.Header.Set("X-SSL-Client-Cert", c.header)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != c.want {
+			t.Errorf("%s: got HTTP %d, want %d", c.name, recorder.Code, c.want)
+		}
+
+		if c.want == http.StatusOK {
+			if len(passed) < 1 || !passed[0][0].Equal(good) {
+				t.Errorf("%s: verified chains not passed on", c.name)
+			}
+		} else if passed != nil {
+			t.Errorf("%s: request passed on", c.name)
+		}
+	}
+}
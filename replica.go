@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// replicaHeartbeatInterval is how often the primary's heartbeat is updated for measuring the replica's lag.
+const replicaHeartbeatInterval = 5 * time.Second
+
+var replicaStale = errors.New("replica lags too far behind")
+
+// replica is nil unless a read replica is configured.
+var replica *sql.DB = nil
+
+// replicaMaxLag is how far the replica may lag behind the primary to be used.
+var replicaMaxLag time.Duration
+
+var replicaReads = metricsRegisterCounter("replica_reads_total", "Read-only transactions served by the replica")
+var replicaFallbacks = metricsRegisterCounter(
+	"replica_fallbacks_total", "Read-only transactions served by the primary as the replica was down or lagging",
+)
+
+func init() {
+	metricsRegisterGauge("replica_lag_seconds", "How far the replica lags behind the primary", func() float64 {
+		if replica == nil {
+			return 0
+		}
+
+		var lag float64 = -1
+
+		dbTryReplicaTx(context.Background(), func(tx *sql.Tx) (err error) {
+			var lagDr time.Duration
+			if lagDr, err = dbGetReplicaLag(tx); err == nil {
+				lag = lagDr.Seconds()
+			}
+
+			return
+		})
+
+		return lag
+	})
+}
+
+// replicaHeartbeat updates the heartbeat on the primary forever.
+func replicaHeartbeat() {
+	for {
+		errTx := dbTx(context.Background(), "", func(tx *sql.Tx) error {
+			_, errExec := dbExec(
+				tx,
+				`INSERT INTO heartbeat(id, time) VALUES (1, UNIX_TIMESTAMP()) ON DUPLICATE KEY UPDATE time=VALUES(time)`,
+			)
+			return errExec
+		})
+		if errTx != nil {
+			log.WithFields(log.Fields{"error": errTx}).Error("Couldn't update heartbeat")
+		}
+
+		time.Sleep(replicaHeartbeatInterval)
+	}
+}
+
+func dbGetReplicaLag(tx *sql.Tx) (time.Duration, error) {
+	rows, errQuery := dbQuery(tx, `SELECT UNIX_TIMESTAMP()-time FROM heartbeat WHERE id=1`)
+	if errQuery != nil {
+		return 0, errQuery
+	}
+
+	if len(rows) < 1 {
+		return 0, replicaStale
+	}
+
+	return time.Duration(dbInt(rows[0][0])) * time.Second, nil
+}
+
+// dbReadTx runs the read-only f on the replica if it's up and not lagging too far behind, on the primary otherwise.
+// actor is only recorded if f runs on the primary.
+func dbReadTx(ctx context.Context, actor string, f func(tx *sql.Tx) error) error {
+	if replica != nil {
+		var errF error = nil
+
+		errTx := dbTryReplicaTx(ctx, func(tx *sql.Tx) error {
+			lag, errGRL := dbGetReplicaLag(tx)
+			if errGRL != nil {
+				return errGRL
+			}
+
+			if lag > replicaMaxLag {
+				return replicaStale
+			}
+
+			errF = f(tx)
+			return errF
+		})
+
+		switch {
+		case errTx == nil:
+			replicaReads.inc()
+			return nil
+		case errTx == errF && !isRecoverableDbError(errF):
+			// Not the replica's fault.
+			return errF
+		case ctx.Err() != nil:
+			return ctx.Err()
+		}
+
+		replicaFallbacks.inc()
+		log.WithFields(log.Fields{"error": errTx}).Warn("Falling back to primary database")
+	}
+
+	return dbTx(ctx, actor, f)
+}
+
+func dbTryReplicaTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, errBT := replica.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if errBT != nil {
+		return errBT
+	}
+
+	if errTx := f(tx); errTx != nil {
+		tx.Rollback()
+		return errTx
+	}
+
+	return tx.Commit()
+}
@@ -22,3 +22,170 @@ CREATE TABLE IF NOT EXISTS task (
   KEY (package),
   KEY (approved)
 );
+
+CREATE TABLE IF NOT EXISTS webhook_outbox (
+  id          BIGINT unsigned PRIMARY KEY AUTO_INCREMENT,
+  webhook     VARCHAR(191)    NOT NULL,
+  event       VARCHAR(191)    NOT NULL,
+  payload     TEXT            NOT NULL,
+  ctime       BIGINT          NOT NULL,
+  next_try    BIGINT          NOT NULL,
+  tries       INT unsigned    NOT NULL,
+  last_error  TEXT,
+
+  KEY (next_try)
+);
+
+ALTER TABLE task ADD COLUMN ctime BIGINT;
+
+CREATE TABLE IF NOT EXISTS digest (
+  id    BIGINT unsigned PRIMARY KEY AUTO_INCREMENT,
+  ctime BIGINT          NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS approval_link (
+  nonce         VARCHAR(191)    PRIMARY KEY,
+  identity      VARCHAR(191)    NOT NULL,
+  agent         VARCHAR(191),
+  package       VARCHAR(191)    NOT NULL,
+  from_version  VARCHAR(191),
+  to_version    VARCHAR(191),
+  action        ENUM('install', 'update', 'configure', 'remove', 'purge') NOT NULL,
+  approved      BIGINT unsigned NOT NULL,
+  ctime         BIGINT          NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS audit (
+  id            BIGINT unsigned PRIMARY KEY AUTO_INCREMENT,
+  time          BIGINT          NOT NULL,
+  actor         VARCHAR(191),
+  event         ENUM('agent_create', 'task_pending', 'task_unpending', 'task_approve', 'task_revoke', 'task_update', 'task_deny') NOT NULL,
+  agent         VARCHAR(191),
+  package       VARCHAR(191),
+  from_version  VARCHAR(191),
+  to_version    VARCHAR(191),
+  action        ENUM('install', 'update', 'configure', 'remove', 'purge'),
+  before_value  TEXT,
+  after_value   TEXT,
+
+  KEY (time),
+  KEY (agent),
+  KEY (package)
+);
+
+CREATE TRIGGER audit_agent_insert AFTER INSERT ON agent FOR EACH ROW
+INSERT INTO audit(time, actor, event, agent, after_value)
+VALUES (UNIX_TIMESTAMP(), @masif_actor, 'agent_create', NEW.name, JSON_OBJECT('name', NEW.name));
+
+CREATE TRIGGER audit_task_insert AFTER INSERT ON task FOR EACH ROW
+INSERT INTO audit(time, actor, event, agent, package, from_version, to_version, action, after_value)
+VALUES (
+  UNIX_TIMESTAMP(), @masif_actor, IF(NEW.approved, 'task_approve', 'task_pending'),
+  (SELECT a.name FROM agent a WHERE a.id=NEW.agent), (SELECT p.name FROM package p WHERE p.id=NEW.package),
+  NEW.from_version, NEW.to_version, NEW.action,
+  JSON_OBJECT(
+    'agent', (SELECT a.name FROM agent a WHERE a.id=NEW.agent), 'package', (SELECT p.name FROM package p WHERE p.id=NEW.package),
+    'from_version', NEW.from_version, 'to_version', NEW.to_version, 'action', NEW.action, 'approved', NEW.approved
+  )
+);
+
+CREATE TRIGGER audit_task_update AFTER UPDATE ON task FOR EACH ROW
+INSERT INTO audit(time, actor, event, agent, package, from_version, to_version, action, before_value, after_value)
+SELECT
+  UNIX_TIMESTAMP(), @masif_actor,
+  CASE WHEN NEW.approved > OLD.approved THEN 'task_approve' WHEN NEW.approved < OLD.approved THEN 'task_revoke' ELSE 'task_update' END,
+  (SELECT a.name FROM agent a WHERE a.id=NEW.agent), (SELECT p.name FROM package p WHERE p.id=NEW.package),
+  NEW.from_version, NEW.to_version, NEW.action,
+  JSON_OBJECT(
+    'agent', (SELECT a.name FROM agent a WHERE a.id=OLD.agent), 'package', (SELECT p.name FROM package p WHERE p.id=OLD.package),
+    'from_version', OLD.from_version, 'to_version', OLD.to_version, 'action', OLD.action, 'approved', OLD.approved
+  ),
+  JSON_OBJECT(
+    'agent', (SELECT a.name FROM agent a WHERE a.id=NEW.agent), 'package', (SELECT p.name FROM package p WHERE p.id=NEW.package),
+    'from_version', NEW.from_version, 'to_version', NEW.to_version, 'action', NEW.action, 'approved', NEW.approved
+  )
+FROM DUAL
+WHERE NOT (
+  NEW.agent <=> OLD.agent AND NEW.package <=> OLD.package AND NEW.from_version <=> OLD.from_version
+  AND NEW.to_version <=> OLD.to_version AND NEW.action <=> OLD.action AND NEW.approved <=> OLD.approved
+);
+
+CREATE TRIGGER audit_task_delete AFTER DELETE ON task FOR EACH ROW
+INSERT INTO audit(time, actor, event, agent, package, from_version, to_version, action, before_value)
+VALUES (
+  UNIX_TIMESTAMP(), @masif_actor, IF(OLD.approved, 'task_revoke', 'task_unpending'),
+  (SELECT a.name FROM agent a WHERE a.id=OLD.agent), (SELECT p.name FROM package p WHERE p.id=OLD.package),
+  OLD.from_version, OLD.to_version, OLD.action,
+  JSON_OBJECT(
+    'agent', (SELECT a.name FROM agent a WHERE a.id=OLD.agent), 'package', (SELECT p.name FROM package p WHERE p.id=OLD.package),
+    'from_version', OLD.from_version, 'to_version', OLD.to_version, 'action', OLD.action, 'approved', OLD.approved
+  )
+);
+
+CREATE TABLE IF NOT EXISTS approval_vote (
+  id            BIGINT unsigned PRIMARY KEY AUTO_INCREMENT,
+  agent         BIGINT unsigned REFERENCES agent(id),
+  package       BIGINT unsigned REFERENCES package(id),
+  from_version  VARCHAR(191),
+  to_version    VARCHAR(191),
+  action        ENUM('install', 'update', 'configure', 'remove', 'purge'),
+  approver      VARCHAR(191)    NOT NULL,
+  ctime         BIGINT          NOT NULL,
+
+  KEY (agent),
+  KEY (package)
+);
+
+ALTER TABLE audit MODIFY COLUMN event ENUM('agent_create', 'task_pending', 'task_unpending', 'task_approve', 'task_revoke', 'task_update', 'task_deny', 'task_vote') NOT NULL;
+
+ALTER TABLE task ADD COLUMN blocking TINYINT(1) unsigned NOT NULL DEFAULT 0;
+
+ALTER TABLE agent ADD COLUMN fingerprint CHAR(64);
+
+CREATE TRIGGER fingerprint_task_delete AFTER DELETE ON task FOR EACH ROW
+UPDATE agent SET fingerprint=NULL WHERE id=OLD.agent;
+
+CREATE TABLE IF NOT EXISTS approval_version (
+  id      TINYINT unsigned PRIMARY KEY,
+  version BIGINT unsigned  NOT NULL
+);
+
+INSERT IGNORE INTO approval_version(id, version) VALUES (1, 0);
+
+CREATE TRIGGER approval_version_task_insert AFTER INSERT ON task FOR EACH ROW
+UPDATE approval_version SET version=version+1 WHERE id=1 AND NEW.approved=1;
+
+CREATE TRIGGER approval_version_task_update AFTER UPDATE ON task FOR EACH ROW
+UPDATE approval_version SET version=version+1 WHERE id=1 AND (NEW.approved=1 OR OLD.approved=1);
+
+CREATE TRIGGER approval_version_task_delete AFTER DELETE ON task FOR EACH ROW
+UPDATE approval_version SET version=version+1 WHERE id=1 AND OLD.approved=1;
+
+CREATE TRIGGER approval_version_vote_insert AFTER INSERT ON approval_vote FOR EACH ROW
+UPDATE approval_version SET version=version+1 WHERE id=1;
+
+CREATE TRIGGER approval_version_vote_delete AFTER DELETE ON approval_vote FOR EACH ROW
+UPDATE approval_version SET version=version+1 WHERE id=1;
+
+CREATE TABLE IF NOT EXISTS heartbeat (
+  id    TINYINT unsigned PRIMARY KEY,
+  time  BIGINT           NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS leader (
+  id        TINYINT unsigned PRIMARY KEY,
+  instance  VARCHAR(191)     NOT NULL,
+  since     BIGINT           NOT NULL,
+  heartbeat BIGINT           NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS job (
+  name        VARCHAR(191)    PRIMARY KEY,
+  instance    VARCHAR(191)    NOT NULL,
+  last_start  BIGINT          NOT NULL,
+  last_end    BIGINT,
+  status      ENUM('running', 'success', 'failure') NOT NULL,
+  last_error  TEXT
+);
+
+ALTER TABLE job ADD COLUMN heartbeat BIGINT;
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/masif-upgrader/common"
+	"net/http"
+)
+
+type simulatedTask struct {
+	Agent       string  `json:"agent"`
+	Package     string  `json:"package"`
+	FromVersion *string `json:"from_version"`
+	ToVersion   *string `json:"to_version"`
+	Action      string  `json:"action"`
+}
+
+// simulation tells which currently pending tasks a proposed rule would approve.
+type simulation struct {
+	Agents []string        `json:"agents"`
+	Tasks  []simulatedTask `json:"tasks"`
+}
+
+// simulateWith returns a copy of rules with rule fully approved.
+func simulateWith(rules approvalRules, rule common.PkgMgrTask) approvalRules {
+	result := make(approvalRules, len(rules)+1)
+
+	for task, approvers := range rules {
+		result[task] = approvers
+	}
+
+	result[rule] = nil
+	return result
+}
+
+// dbSimulate evaluates rule for agent (or all agents if empty) against the current pending tasks
+// the same way dbUpdatePendingTasks does, but without writing anything.
+func dbSimulate(tx *sql.Tx, agent string, rule common.PkgMgrTask) (*simulation, error) {
+	if _, errGAI := dbGetAgentId(tx, agent); errGAI != nil {
+		return nil, errGAI
+	}
+
+	globalApprovals, errDGA := dbGetApprovals(tx, nil)
+	if errDGA != nil {
+		return nil, errDGA
+	}
+
+	simulatedGlobalApprovals := globalApprovals
+	if agent == "" {
+		simulatedGlobalApprovals = simulateWith(globalApprovals, rule)
+	}
+
+	query := `
+SELECT a.id, a.name, p.name, t.from_version, t.to_version, t.action
+FROM task t
+INNER JOIN agent a ON a.id=t.agent
+LEFT JOIN package p ON p.id=t.package
+WHERE t.approved=0`
+
+	values := []interface{}{}
+
+	if agent != "" {
+		query += " AND a.name=?"
+		values = append(values, agent)
+	}
+
+	rows, errQuery := dbQuery(tx, query+" ORDER BY a.name, p.name, t.from_version, t.to_version, t.action", values...)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+
+	result := &simulation{Agents: []string{}, Tasks: []simulatedTask{}}
+
+	var agentId int64 = 0
+	var agentApprovals, simulatedAgentApprovals approvalRules
+	var agentApproved bool
+
+	for _, row := range rows {
+		if id := dbInt(row[0]); id != agentId {
+			agentId = id
+			agentApproved = false
+
+			var errDGA error
+			if agentApprovals, errDGA = dbGetApprovals(tx, agentId); errDGA != nil {
+				return nil, errDGA
+			}
+
+			simulatedAgentApprovals = agentApprovals
+			if agent != "" {
+				simulatedAgentApprovals = simulateWith(agentApprovals, rule)
+			}
+		}
+
+		task := dbRow2Task(row[2:])
+
+		if !approvalCheck(task, globalApprovals, agentApprovals) &&
+			approvalCheck(task, simulatedGlobalApprovals, simulatedAgentApprovals) {
+			name := string(row[1].([]byte))
+
+			if !agentApproved {
+				agentApproved = true
+				result.Agents = append(result.Agents, name)
+			}
+
+			result.Tasks = append(result.Tasks, simulatedTask{
+				Agent:       name,
+				Package:     task.PackageName,
+				FromVersion: dbNullableString(row[3]),
+				ToVersion:   dbNullableString(row[4]),
+				Action:      pkgMgrAction2db[task.Action],
+			})
+		}
+	}
+
+	return result, nil
+}
+
+// adminV1Simulations tells which currently pending tasks a proposed approval would approve.
+func adminV1Simulations(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	agent, task, errPR := adminReadRule(writer, request)
+	if errPR != nil {
+		return
+	}
+
+	var result *simulation
+
+	if adminRespondError(writer, dbReadTx(request.Context(), adminActor(request), func(tx *sql.Tx) (err error) {
+		result, err = dbSimulate(tx, agent, task)
+		return
+	})) {
+		return
+	}
+
+	adminRespond(writer, result)
+}
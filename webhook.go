@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/masif-upgrader/common"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookTaskPending is emitted when an agent reports a task which isn't approved yet.
+	webhookTaskPending = "task.pending"
+	// webhookTaskApproved is emitted when a pending task has been approved and handed out to its agent.
+	webhookTaskApproved = "task.approved"
+)
+
+const webhookMinBackoff = 5 * time.Second
+const webhookBatchSize = 100
+const webhookTimeout = 10 * time.Second
+const webhookMaxBackoff = time.Hour
+
+var webhookEvents = map[string]struct{}{webhookTaskPending: {}, webhookTaskApproved: {}}
+
+var webhookDeliveries = metricsRegisterCounter("webhook_deliveries_total", "Delivered webhook events")
+var webhookFailures = metricsRegisterCounter("webhook_failures_total", "Failed webhook event deliveries")
+
+type webhook struct {
+	name, url, secret string
+	events            map[string]struct{}
+}
+
+// webhooks are all configured webhooks by name.
+var webhooks = map[string]*webhook{}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+func webhookSubscribed(event string) bool {
+	for _, hook := range webhooks {
+		if _, subscribed := hook.events[event]; subscribed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// webhookEnqueue stores an event per task and subscribed webhook in the outbox as part of tx.
+func webhookEnqueue(tx *sql.Tx, event, agent string, tasks map[common.PkgMgrTask]struct{}) error {
+	if len(tasks) < 1 {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	placeholders := []string{}
+	values := []interface{}{}
+
+	for task := range tasks {
+		record := map[string]interface{}{
+			"event":   event,
+			"time":    now,
+			"agent":   agent,
+			"package": task.PackageName,
+			"action":  pkgMgrAction2db[task.Action],
+		}
+
+		if task.FromVersion != "" {
+			record["from_version"] = task.FromVersion
+		}
+
+		if task.ToVersion != "" {
+			record["to_version"] = task.ToVersion
+		}
+
+		for _, hook := range webhooks {
+			if _, subscribed := hook.events[event]; !subscribed {
+				continue
+			}
+
+			id := make([]byte, 16)
+			if _, errRd := io.ReadFull(rand.Reader, id); errRd != nil {
+				return errRd
+			}
+
+			record["id"] = hex.EncodeToString(id)
+
+			if approvalLinks != nil && event == webhookTaskPending {
+				for key, linkAgent := range map[string]string{"approve_url": agent, "approve_fleet_url": ""} {
+					link, errLM := linkMake("webhook:"+hook.name, linkAgent, task)
+					if errLM != nil {
+						return errLM
+					}
+
+					record[key] = link
+				}
+			}
+
+			payload, errJM := json.Marshal(record)
+			if errJM != nil {
+				return errJM
+			}
+
+			placeholders = append(placeholders, "(?, ?, ?, ?, ?, 0)")
+			values = append(values, hook.name, event, payload, now, now)
+		}
+	}
+
+	if len(placeholders) < 1 {
+		return nil
+	}
+
+	_, errExec := dbExec(
+		tx,
+		`INSERT INTO webhook_outbox(webhook, event, payload, ctime, next_try, tries) VALUES `+
+			strings.Join(placeholders, ", "),
+		values...,
+	)
+	return errExec
+}
+
+type webhookOutboxEvent struct {
+	id      int64
+	webhook string
+	event   string
+	payload []byte
+	tries   uint64
+}
+
+// webhookDeliverDue delivers the events due in the outbox, failed ones are retried with exponential back-off.
+func webhookDeliverDue(ctx context.Context) error {
+	for {
+		due, errGD := webhookGetDue()
+		if errGD != nil {
+			return errGD
+		}
+
+		for _, event := range due {
+			webhookDeliverOne(event)
+		}
+
+		if len(due) < webhookBatchSize || ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+func webhookGetDue() (due []webhookOutboxEvent, err error) {
+	err = dbTx(context.Background(), "", func(tx *sql.Tx) error {
+		rows, errQuery := dbQuery(
+			tx,
+			`SELECT id, webhook, event, payload, tries FROM webhook_outbox WHERE next_try <= ? ORDER BY id LIMIT ?`,
+			time.Now().Unix(),
+			webhookBatchSize,
+		)
+		if errQuery != nil {
+			return errQuery
+		}
+
+		due = make([]webhookOutboxEvent, 0, len(rows))
+
+		for _, row := range rows {
+			due = append(due, webhookOutboxEvent{
+				id:      row[0].(int64),
+				webhook: string(row[1].([]byte)),
+				event:   string(row[2].([]byte)),
+				payload: row[3].([]byte),
+				tries:   uint64(row[4].(int64)),
+			})
+		}
+
+		return nil
+	})
+
+	return
+}
+
+func webhookDeliverOne(event webhookOutboxEvent) {
+	fields := log.Fields{"webhook": event.webhook, "event": event.event, "id": event.id, "tries": event.tries}
+
+	hook, isConfigured := webhooks[event.webhook]
+	if !isConfigured {
+		log.WithFields(fields).Warn("Dropping event for webhook not configured anymore")
+
+		if errDl := webhookDelete(event.id); errDl != nil {
+			log.WithFields(fields).WithFields(log.Fields{"error": errDl}).Error("Couldn't drop webhook event")
+		}
+
+		return
+	}
+
+	log.WithFields(fields).Debug("Delivering webhook event")
+
+	if errPost := webhookPost(hook, event); errPost != nil {
+		webhookFailures.inc()
+
+		backoff := webhookMaxBackoff
+		if event.tries < 10 {
+			if exp := time.Duration(1<<event.tries) * webhookMinBackoff; exp < backoff {
+				backoff = exp
+			}
+		}
+
+		log.WithFields(fields).WithFields(log.Fields{
+			"error": errPost, "retry_in": backoff,
+		}).Warn("Couldn't deliver webhook event")
+
+		errUp := dbTx(context.Background(), "", func(tx *sql.Tx) error {
+			_, errExec := dbExec(
+				tx,
+				`UPDATE webhook_outbox SET tries=tries+1, next_try=?, last_error=? WHERE id=?`,
+				time.Now().Add(backoff).Unix(),
+				errPost.Error(),
+				event.id,
+			)
+			return errExec
+		})
+		if errUp != nil {
+			log.WithFields(fields).WithFields(log.Fields{"error": errUp}).Error("Couldn't reschedule webhook event")
+		}
+
+		return
+	}
+
+	webhookDeliveries.inc()
+
+	if errDl := webhookDelete(event.id); errDl != nil {
+		log.WithFields(fields).WithFields(log.Fields{"error": errDl}).Error("Couldn't remove delivered webhook event")
+	}
+}
+
+func webhookPost(hook *webhook, event webhookOutboxEvent) error {
+	request, errNR := http.NewRequest("POST", hook.url, bytes.NewReader(event.payload))
+	if errNR != nil {
+		return errNR
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Masif-Upgrader-Event", event.event)
+
+	if hook.secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.secret))
+		mac.Write(event.payload)
+
+		request.Header.Set("X-Masif-Upgrader-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, errDo := webhookClient.Do(request)
+	if errDo != nil {
+		return errDo
+	}
+
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("HTTP %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+func webhookDelete(id int64) error {
+	return dbTx(context.Background(), "", func(tx *sql.Tx) error {
+		_, errExec := dbExec(tx, `DELETE FROM webhook_outbox WHERE id=?`, id)
+		return errExec
+	})
+}